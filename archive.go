@@ -0,0 +1,109 @@
+package dlog
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReadArchive calls f with every record in a file written by
+// FileSink or WriterSink, which might be gzipped.  Use Reader to open
+// the records.
+func ReadArchive(path string, f func(data []byte) error) error {
+	file, e := os.Open(path)
+	if e != nil {
+		return e
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, gzipExt) {
+		gz, e := gzip.NewReader(file)
+		if e != nil {
+			return e
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	for {
+		data, e := readFrame(r)
+		if e == io.EOF {
+			return nil
+		} else if e != nil {
+			return e
+		}
+
+		if e := f(data); e != nil {
+			return e
+		}
+	}
+}
+
+// ReadArchiveDir calls ReadArchive for files of stream written by
+// FileSink into dir, in the order they were created.
+func ReadArchiveDir(dir, stream string, f func(data []byte) error) error {
+	type archiveFile struct {
+		path    string
+		created time.Time
+		serial  int
+	}
+
+	var files []archiveFile
+	e := filepath.Walk(dir, func(path string, info os.FileInfo, e error) error {
+		if e != nil {
+			return e
+		}
+		if info.IsDir() || !isArchiveFile(path) {
+			return nil
+		}
+		if created, serial, ok := parseArchiveName(info.Name(), stream); ok {
+			files = append(files, archiveFile{path, created, serial})
+		}
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].created.Equal(files[j].created) {
+			return files[i].created.Before(files[j].created)
+		}
+		return files[i].serial < files[j].serial
+	})
+	for _, file := range files {
+		if e := ReadArchive(file.path, f); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// parseArchiveName returns the creation time and the serial number of
+// a file of stream named by FileSink.  It returns false for files of
+// other streams.
+func parseArchiveName(name, stream string) (created time.Time, serial int, ok bool) {
+	if !strings.HasPrefix(name, stream+"-") {
+		return time.Time{}, 0, false
+	}
+	rest := strings.TrimSuffix(strings.TrimSuffix(name[len(stream)+1:], gzipExt), fileExt)
+
+	if len(rest) < len(fileTimeLayout)+2 || rest[len(fileTimeLayout)] != '-' {
+		return time.Time{}, 0, false
+	}
+	created, e := time.Parse(fileTimeLayout, rest[:len(fileTimeLayout)])
+	if e != nil {
+		return time.Time{}, 0, false
+	}
+	serial, e = strconv.Atoi(rest[len(fileTimeLayout)+1:])
+	if e != nil {
+		return time.Time{}, 0, false
+	}
+	return created, serial, true
+}
@@ -0,0 +1,97 @@
+package dlog
+
+import "time"
+
+const (
+	// Maximum number of records in a PutRecords call.
+	maxBatchRecords = 500
+
+	// Default minimum linger of the adaptive batch age.
+	defaultMinBatchAge = 10 * time.Millisecond
+)
+
+// batchTrigger decides when the sync goroutine flushes the batch: if
+// it has maxRecords records or maxBytes bytes, or if its first record
+// has waited for linger.  If adaptive, linger is between minAge and
+// maxAge, doubled after flushes of fuller batches and halved after
+// flushes of almost empty ones.
+type batchTrigger struct {
+	maxRecords int
+	maxBytes   int
+	maxAge     time.Duration
+	minAge     time.Duration
+	adaptive   bool
+	linger     time.Duration
+}
+
+func newBatchTrigger(o *Options) *batchTrigger {
+	t := &batchTrigger{
+		maxRecords: o.BatchRecords,
+		maxBytes:   o.BatchBytes,
+		maxAge:     o.BatchAge,
+		minAge:     o.MinBatchAge,
+		adaptive:   o.AdaptiveLinger,
+	}
+
+	if t.maxRecords <= 0 || t.maxRecords > maxBatchRecords {
+		t.maxRecords = maxBatchRecords
+	}
+	if t.maxBytes <= 0 || t.maxBytes > maxBatchSize {
+		t.maxBytes = maxBatchSize
+	}
+	if t.maxAge <= 0 {
+		t.maxAge = o.SyncPeriod
+	}
+	if t.maxAge <= 0 {
+		t.maxAge = time.Second
+	}
+	if t.minAge <= 0 || t.minAge > t.maxAge {
+		t.minAge = defaultMinBatchAge
+		if t.minAge > t.maxAge {
+			t.minAge = t.maxAge
+		}
+	}
+
+	t.linger = t.maxAge
+	if t.adaptive {
+		t.linger = t.minAge
+	}
+	return t
+}
+
+// fits returns if a record of the given size can be added into a
+// batch of records and bytes without exceeding the limits.
+func (t *batchTrigger) fits(records, bytes, size int) bool {
+	return records+1 <= t.maxRecords && bytes+size <= t.maxBytes
+}
+
+// full returns if a batch of records and bytes should be flushed
+// without waiting for linger.
+func (t *batchTrigger) full(records, bytes int) bool {
+	return records >= t.maxRecords || bytes >= t.maxBytes
+}
+
+// adapt updates linger after flushing a batch of records and bytes.
+func (t *batchTrigger) adapt(records, bytes int) {
+	if !t.adaptive {
+		return
+	}
+
+	fill := float64(records) / float64(t.maxRecords)
+	if f := float64(bytes) / float64(t.maxBytes); f > fill {
+		fill = f
+	}
+
+	switch {
+	case fill >= 0.5: // Busy, wait longer for bigger batches.
+		t.linger *= 2
+		if t.linger > t.maxAge {
+			t.linger = t.maxAge
+		}
+	case fill < 0.1: // Quiet, don't keep records waiting.
+		t.linger /= 2
+		if t.linger < t.minAge {
+			t.linger = t.minAge
+		}
+	}
+}
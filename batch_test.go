@@ -0,0 +1,97 @@
+package dlog
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchTriggerDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := newBatchTrigger(&Options{})
+	assert.Equal(maxBatchRecords, tr.maxRecords)
+	assert.Equal(maxBatchSize, tr.maxBytes)
+	assert.Equal(time.Second, tr.linger)
+
+	tr = newBatchTrigger(&Options{BatchRecords: 1000, SyncPeriod: time.Minute})
+	assert.Equal(maxBatchRecords, tr.maxRecords)
+	assert.Equal(time.Minute, tr.linger)
+
+	assert.True(tr.fits(499, 0, 10))
+	assert.False(tr.fits(500, 0, 10))
+	assert.False(tr.fits(1, maxBatchSize-5, 10))
+	assert.True(tr.full(500, 0))
+	assert.True(tr.full(1, maxBatchSize))
+}
+
+func TestBatchTriggerAdaptiveLinger(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := newBatchTrigger(&Options{
+		BatchRecords:   100,
+		BatchAge:       time.Second,
+		MinBatchAge:    100 * time.Millisecond,
+		AdaptiveLinger: true,
+	})
+	assert.Equal(100*time.Millisecond, tr.linger)
+
+	tr.adapt(60, 0)
+	assert.Equal(200*time.Millisecond, tr.linger)
+	for i := 0; i < 10; i++ {
+		tr.adapt(100, 0)
+	}
+	assert.Equal(time.Second, tr.linger)
+
+	tr.adapt(20, 0) // Neither busy nor quiet.
+	assert.Equal(time.Second, tr.linger)
+
+	for i := 0; i < 10; i++ {
+		tr.adapt(1, 0)
+	}
+	assert.Equal(100*time.Millisecond, tr.linger)
+
+	// Not adaptive.
+	tr = newBatchTrigger(&Options{BatchAge: time.Second})
+	tr.adapt(1, 0)
+	assert.Equal(time.Second, tr.linger)
+}
+
+func TestBatchTriggers(t *testing.T) {
+	assert := assert.New(t)
+
+	l, e := NewLogger(&impression{}, &Options{
+		BatchRecords:   3,
+		BatchAge:       time.Hour,
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+
+	// The count trigger doesn't wait for the batch age.
+	for i := 0; i < 3; i++ {
+		assert.Nil(l.Log(impression{Session: strconv.Itoa(i)}))
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal("1", l.writtenBatches.String())
+	assert.Equal("3", l.writtenRecords.String())
+
+	// The age is measured from the first record of the batch.
+	l, e = NewLogger(&impression{}, &Options{
+		BatchAge:       300 * time.Millisecond,
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Nil(l.Log(impression{}))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal("0", l.writtenBatches.String())
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal("1", l.writtenBatches.String())
+}
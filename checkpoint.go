@@ -0,0 +1,48 @@
+package dlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// CheckpointStore persists the state of consumers, like the filter of
+// DedupFilter, by name.
+type CheckpointStore interface {
+	// Load returns the state saved as name, or nil if there is none.
+	Load(name string) ([]byte, error)
+
+	Save(name string, data []byte) error
+}
+
+// FileCheckpointStore saves each state into a file in a directory.
+type FileCheckpointStore struct {
+	Dir string
+}
+
+func (s *FileCheckpointStore) Load(name string) ([]byte, error) {
+	data, e := ioutil.ReadFile(filepath.Join(s.Dir, name))
+	if os.IsNotExist(e) {
+		return nil, nil
+	}
+	return data, e
+}
+
+// Save writes a temporary file and renames it, so that a crash never
+// leaves a partial state.
+func (s *FileCheckpointStore) Save(name string, data []byte) error {
+	f, e := ioutil.TempFile(s.Dir, name+".tmp")
+	if e != nil {
+		return e
+	}
+	defer os.Remove(f.Name())
+
+	if _, e := f.Write(data); e != nil {
+		f.Close()
+		return e
+	}
+	if e := f.Close(); e != nil {
+		return e
+	}
+	return os.Rename(f.Name(), filepath.Join(s.Dir, name))
+}
@@ -0,0 +1,469 @@
+package dlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/kinesis"
+)
+
+const defaultCredentialsMargin = 5 * time.Minute
+
+// ErrNoCredentials is returned by CredentialsProviders that find no
+// credentials, so CredentialsChain tries the next one.
+var ErrNoCredentials = errors.New("dlog: no AWS credentials")
+
+// Credentials are AWS credentials.  Temporary credentials have a
+// SessionToken and an Expiration.
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Expiration   time.Time
+}
+
+func (c *Credentials) auth() aws.Auth {
+	return *aws.NewAuth(c.AccessKey, c.SecretKey, c.SessionToken, c.Expiration)
+}
+
+func (c *Credentials) equal(o *Credentials) bool {
+	return c.AccessKey == o.AccessKey && c.SecretKey == o.SecretKey &&
+		c.SessionToken == o.SessionToken && c.Expiration.Equal(o.Expiration)
+}
+
+// CredentialsProvider retrieves AWS credentials.  Wrap providers of
+// temporary credentials in CachedCredentials to refresh them before
+// they expire.
+type CredentialsProvider interface {
+	Retrieve() (*Credentials, error)
+}
+
+// StaticCredentials are fixed credentials, like Options.AccessKey and
+// Options.SecretKey.
+type StaticCredentials Credentials
+
+func (c *StaticCredentials) Retrieve() (*Credentials, error) {
+	if len(c.AccessKey) <= 0 || len(c.SecretKey) <= 0 {
+		return nil, fmt.Errorf("%w: empty static credentials", ErrNoCredentials)
+	}
+	creds := Credentials(*c)
+	return &creds, nil
+}
+
+// EnvCredentials reads AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN.
+type EnvCredentials struct{}
+
+func (EnvCredentials) Retrieve() (*Credentials, error) {
+	c := &Credentials{
+		AccessKey:    firstEnv("AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY"),
+		SecretKey:    firstEnv("AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if len(c.AccessKey) <= 0 || len(c.SecretKey) <= 0 {
+		return nil, fmt.Errorf("%w in environment variables", ErrNoCredentials)
+	}
+	return c, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// SharedCredentials reads a profile of the shared credentials file,
+// ~/.aws/credentials, or else of the config file, ~/.aws/config.
+// Empty fields default to AWS_SHARED_CREDENTIALS_FILE, AWS_CONFIG_FILE
+// and AWS_PROFILE, and then to the files in ~/.aws and the profile
+// "default".
+//
+// Profiles with role_arn assume the role by STS with the credentials
+// of source_profile, or of credential_source, which is Environment,
+// Ec2InstanceMetadata or EcsContainer.  external_id,
+// role_session_name, duration_seconds and region of the profile are
+// passed to AssumeRoleCredentials, with Endpoint and Client.
+type SharedCredentials struct {
+	Filename       string
+	ConfigFilename string
+	Profile        string
+
+	Endpoint string
+	Client   *http.Client
+}
+
+func (s *SharedCredentials) Retrieve() (*Credentials, error) {
+	profile := s.Profile
+	if len(profile) <= 0 {
+		profile = firstEnv("AWS_PROFILE", "AWS_DEFAULT_PROFILE")
+	}
+	if len(profile) <= 0 {
+		profile = "default"
+	}
+
+	var files []map[string]map[string]string
+	for _, path := range []string{
+		awsFile(s.Filename, "AWS_SHARED_CREDENTIALS_FILE", "credentials"),
+		awsFile(s.ConfigFilename, "AWS_CONFIG_FILE", "config"),
+	} {
+		sections, e := parseINI(path)
+		if os.IsNotExist(e) {
+			sections = nil
+		} else if e != nil {
+			return nil, e
+		}
+		files = append(files, sections)
+	}
+	return s.retrieve(files, profile, make(map[string]bool))
+}
+
+// retrieve returns the credentials of profile in files, the sections
+// of the credentials and config files.  visited are profiles that
+// source profile, to catch cycles.
+func (s *SharedCredentials) retrieve(files []map[string]map[string]string, profile string,
+	visited map[string]bool) (*Credentials, error) {
+	if visited[profile] {
+		return nil, fmt.Errorf("Cyclic source_profile of AWS profile %s", profile)
+	}
+	visited[profile] = true
+
+	// Keys of the credentials file override those of the config file.
+	keys := make(map[string]string)
+	for k, v := range files[1][configSection(profile)] {
+		keys[k] = v
+	}
+	for k, v := range files[0][profile] {
+		keys[k] = v
+	}
+
+	static := &Credentials{
+		AccessKey:    keys["aws_access_key_id"],
+		SecretKey:    keys["aws_secret_access_key"],
+		SessionToken: keys["aws_session_token"],
+	}
+	if len(keys["role_arn"]) <= 0 {
+		if len(static.AccessKey) > 0 && len(static.SecretKey) > 0 {
+			return static, nil
+		}
+		return nil, fmt.Errorf("%w in profile %s", ErrNoCredentials, profile)
+	}
+
+	if len(keys["mfa_serial"]) > 0 {
+		return nil, fmt.Errorf("AWS profile %s requires MFA, which dlog doesn't support", profile)
+	}
+
+	var source CredentialsProvider
+	switch src := keys["source_profile"]; {
+	case src == profile:
+		// A profile may assume a role with its own keys.
+		c := StaticCredentials(*static)
+		source = &c
+	case len(src) > 0:
+		c, e := s.retrieve(files, src, visited)
+		if e != nil {
+			return nil, fmt.Errorf("Cannot retrieve source_profile %s of AWS profile %s: %w", src, profile, e)
+		}
+		sc := StaticCredentials(*c)
+		source = &sc
+	default:
+		switch cs := keys["credential_source"]; cs {
+		case "Environment":
+			source = EnvCredentials{}
+		case "Ec2InstanceMetadata":
+			source = &InstanceMetadataCredentials{}
+		case "EcsContainer":
+			source = &ContainerCredentials{}
+		default:
+			return nil, fmt.Errorf("AWS profile %s has role_arn, but unknown credential_source %q and no source_profile",
+				profile, cs)
+		}
+	}
+
+	var duration time.Duration
+	if d := keys["duration_seconds"]; len(d) > 0 {
+		seconds, e := strconv.Atoi(d)
+		if e != nil {
+			return nil, fmt.Errorf("Invalid duration_seconds %q of AWS profile %s", d, profile)
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+
+	return (&AssumeRoleCredentials{
+		Source:      source,
+		RoleARN:     keys["role_arn"],
+		SessionName: keys["role_session_name"],
+		ExternalID:  keys["external_id"],
+		Duration:    duration,
+		Region:      keys["region"],
+		Endpoint:    s.Endpoint,
+		Client:      s.Client,
+	}).Retrieve()
+}
+
+func awsFile(path, env, name string) string {
+	if len(path) > 0 {
+		return path
+	}
+	if path = os.Getenv(env); len(path) > 0 {
+		return path
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".aws", name)
+}
+
+// configSection returns the section of profile in the config file.
+func configSection(profile string) string {
+	if profile == "default" {
+		return profile
+	}
+	return "profile " + profile
+}
+
+// parseINI returns keys of each section of the INI file at path.
+func parseINI(path string) (map[string]map[string]string, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+
+	sections := make(map[string]map[string]string)
+	var keys map[string]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case len(line) == 0 || line[0] == '#' || line[0] == ';':
+		case line[0] == '[' && line[len(line)-1] == ']':
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if keys = sections[name]; keys == nil {
+				keys = make(map[string]string)
+				sections[name] = keys
+			}
+		default:
+			if i := strings.Index(line, "="); i > 0 && keys != nil {
+				keys[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	return sections, scanner.Err()
+}
+
+// CredentialsChain returns the credentials of the first provider that
+// has credentials.
+type CredentialsChain []CredentialsProvider
+
+func (chain CredentialsChain) Retrieve() (*Credentials, error) {
+	var errs []string
+	for _, p := range chain {
+		c, e := p.Retrieve()
+		if e == nil {
+			return c, nil
+		}
+		errs = append(errs, e.Error())
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoCredentials, strings.Join(errs, "; "))
+}
+
+// DefaultCredentials returns the chain of environment variables, web
+// identity, shared credentials and config files, container metadata
+// and instance metadata, like AWS SDKs.  Web identity and container
+// metadata are in the chain only if their environment variables are
+// set.
+func DefaultCredentials() CredentialsProvider {
+	chain := CredentialsChain{EnvCredentials{}}
+	if len(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")) > 0 {
+		chain = append(chain, &WebIdentityCredentials{})
+	}
+	chain = append(chain, &SharedCredentials{})
+	if len(firstEnv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI")) > 0 {
+		chain = append(chain, &ContainerCredentials{})
+	}
+	chain = append(chain, &InstanceMetadataCredentials{})
+	return &CachedCredentials{Provider: chain}
+}
+
+// CachedCredentials caches credentials of Provider, and retrieves new
+// ones Margin before they expire.  0 means 5 minutes.  If the refresh
+// fails, the cached credentials are returned until they expire.
+type CachedCredentials struct {
+	Provider CredentialsProvider
+	Margin   time.Duration
+
+	lock  sync.Mutex
+	creds *Credentials
+	now   func() time.Time
+}
+
+func (c *CachedCredentials) Retrieve() (*Credentials, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.now == nil {
+		c.now = time.Now
+	}
+	margin := c.Margin
+	if margin <= 0 {
+		margin = defaultCredentialsMargin
+	}
+
+	if c.creds != nil && (c.creds.Expiration.IsZero() || c.now().Add(margin).Before(c.creds.Expiration)) {
+		return c.creds, nil
+	}
+
+	creds, e := c.Provider.Retrieve()
+	if e != nil {
+		// The refresh is early, so the cached credentials are still
+		// good until they expire.
+		if c.creds != nil && c.now().Before(c.creds.Expiration) {
+			return c.creds, nil
+		}
+		return nil, e
+	}
+	c.creds = creds
+	return creds, nil
+}
+
+// credentialedKinesis is a Kinesis client that retrieves credentials
+// before every call, and replaces the goamz client when they change.
+type credentialedKinesis struct {
+	credentials CredentialsProvider
+	region      aws.Region
+
+	lock   sync.Mutex
+	creds  Credentials // Of client.
+	client *kinesis.Kinesis
+}
+
+func newCredentialedKinesis(credentials CredentialsProvider, region aws.Region) *credentialedKinesis {
+	return &credentialedKinesis{credentials: credentials, region: region}
+}
+
+func (k *credentialedKinesis) kinesis() (*kinesis.Kinesis, error) {
+	creds, e := k.credentials.Retrieve()
+	if e != nil {
+		return nil, e
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	// Providers like StaticCredentials return new copies of the same
+	// credentials, so compare them by value.
+	if k.client == nil || !creds.equal(&k.creds) {
+		k.creds = *creds
+		k.client = kinesis.New(creds.auth(), k.region)
+	}
+	return k.client, nil
+}
+
+func (k *credentialedKinesis) PutRecords(streamName string, records []kinesis.PutRecordsRequestEntry) (*kinesis.PutRecordsResponse, error) {
+	c, e := k.kinesis()
+	if e != nil {
+		return nil, e
+	}
+	return c.PutRecords(streamName, records)
+}
+
+func (k *credentialedKinesis) CreateStream(name string, shardCount int) error {
+	c, e := k.kinesis()
+	if e != nil {
+		return e
+	}
+	return c.CreateStream(name, shardCount)
+}
+
+func (k *credentialedKinesis) DescribeStream(name string) (*kinesis.StreamDescription, error) {
+	c, e := k.kinesis()
+	if e != nil {
+		return nil, e
+	}
+	return c.DescribeStream(name)
+}
+
+// DescribeStreamPage calls DescribeStream with ExclusiveStartShardId,
+// which goamz doesn't support.
+func (k *credentialedKinesis) DescribeStreamPage(name, exclusiveStartShardId string) (*kinesis.StreamDescription, error) {
+	creds, e := k.credentials.Retrieve()
+	if e != nil {
+		return nil, e
+	}
+
+	body, e := json.Marshal(map[string]string{"StreamName": name, "ExclusiveStartShardId": exclusiveStartShardId})
+	if e != nil {
+		return nil, e
+	}
+	hreq, e := http.NewRequest("POST", k.region.KinesisEndpoint+"/", bytes.NewReader(body))
+	if e != nil {
+		return nil, e
+	}
+	hreq.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	hreq.Header.Set("X-Amz-Target", "Kinesis_20131202.DescribeStream")
+	hreq.Header.Set("X-Amz-Date", time.Now().UTC().Format("20060102T150405Z"))
+	aws.NewV4Signer(creds.auth(), "kinesis", k.region).Sign(hreq)
+
+	hresp, e := http.DefaultClient.Do(hreq)
+	if e != nil {
+		return nil, e
+	}
+	defer hresp.Body.Close()
+
+	content, e := ioutil.ReadAll(hresp.Body)
+	if e != nil {
+		return nil, e
+	}
+
+	if hresp.StatusCode != http.StatusOK {
+		var ke struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(content, &ke)
+		return nil, &kinesis.Error{StatusCode: hresp.StatusCode, Code: ke.Type, Message: ke.Message}
+	}
+
+	var resp struct{ StreamDescription kinesis.StreamDescription }
+	if e := json.Unmarshal(content, &resp); e != nil {
+		return nil, e
+	}
+	return &resp.StreamDescription, nil
+}
+
+func (k *credentialedKinesis) DeleteStream(name string) error {
+	c, e := k.kinesis()
+	if e != nil {
+		return e
+	}
+	return c.DeleteStream(name)
+}
+
+func (k *credentialedKinesis) GetShardIterator(shardId, streamName string, iteratorType kinesis.ShardIteratorType,
+	startingSequenceNumber string) (*kinesis.GetShardIteratorResponse, error) {
+	c, e := k.kinesis()
+	if e != nil {
+		return nil, e
+	}
+	return c.GetShardIterator(shardId, streamName, iteratorType, startingSequenceNumber)
+}
+
+func (k *credentialedKinesis) GetRecords(shardIterator string, limit int) (*kinesis.GetRecordsResponse, error) {
+	c, e := k.kinesis()
+	if e != nil {
+		return nil, e
+	}
+	return c.GetRecords(shardIterator, limit)
+}
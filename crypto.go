@@ -0,0 +1,177 @@
+package dlog
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// ErrUnknownKey is returned by KeyProvider.Key for unknown key IDs.
+var ErrUnknownKey = errors.New("dlog: unknown encryption key")
+
+// KeyProvider provides AES keys, of 16, 24 or 32 bytes, to encrypt
+// and decrypt records.  To rotate keys, change the current key, and
+// keep old keys so that old records can still be decrypted.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new records and its ID.
+	CurrentKey() (id string, key []byte, err error)
+
+	// Key returns the key of id to decrypt records.
+	Key(id string) ([]byte, error)
+}
+
+// Keyring is a KeyProvider loaded from a local JSON file like
+//
+//	{
+//	  "current": "2016-10",
+//	  "keys": {
+//	    "2016-09": "base64-encoded key",
+//	    "2016-10": "base64-encoded key"
+//	  }
+//	}
+type Keyring struct {
+	path string
+
+	lock    sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+type keyringFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// NewKeyring loads the keyring file at path.
+func NewKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if e := k.Reload(); e != nil {
+		return nil, e
+	}
+	return k, nil
+}
+
+// Reload loads the keyring file again, usually after a key rotation.
+func (k *Keyring) Reload() error {
+	content, e := ioutil.ReadFile(k.path)
+	if e != nil {
+		return e
+	}
+
+	var f keyringFile
+	if e := json.Unmarshal(content, &f); e != nil {
+		return fmt.Errorf("Cannot parse keyring %s: %v", k.path, e)
+	}
+
+	keys := make(map[string][]byte, len(f.Keys))
+	for id, encoded := range f.Keys {
+		key, e := base64.StdEncoding.DecodeString(encoded)
+		if e != nil {
+			return fmt.Errorf("Cannot decode key %s in keyring %s: %v", id, k.path, e)
+		}
+		if _, e := aes.NewCipher(key); e != nil {
+			return fmt.Errorf("Invalid key %s in keyring %s: %v", id, k.path, e)
+		}
+		keys[id] = key
+	}
+
+	if _, ok := keys[f.Current]; !ok {
+		return fmt.Errorf("Current key %q not found in keyring %s", f.Current, k.path)
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.current, k.keys = f.Current, keys
+	return nil
+}
+
+func (k *Keyring) CurrentKey() (string, []byte, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *Keyring) Key(id string) ([]byte, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// encryptEnvelope replaces env.Message by its AES-GCM encryption with
+// the current key of keys.  The key ID, sample rate and transformed
+// fields are authenticated too, so they can't be altered without
+// failing decryption.
+func encryptEnvelope(env *Envelope, keys KeyProvider) error {
+	id, key, e := keys.CurrentKey()
+	if e != nil {
+		return e
+	}
+
+	gcm, e := newGCM(key)
+	if e != nil {
+		return e
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, e := io.ReadFull(rand.Reader, nonce); e != nil {
+		return e
+	}
+
+	env.KeyID = id
+	env.Nonce = nonce
+	env.Message = gcm.Seal(nil, nonce, env.Message, additionalData(env))
+	return nil
+}
+
+// decryptEnvelope decrypts env.Message in place if it is encrypted.
+func decryptEnvelope(env *Envelope, keys KeyProvider) error {
+	if len(env.KeyID) <= 0 {
+		return nil
+	}
+	if keys == nil {
+		return fmt.Errorf("dlog record encrypted with key %s, but no KeyProvider", env.KeyID)
+	}
+
+	key, e := keys.Key(env.KeyID)
+	if e != nil {
+		return e
+	}
+
+	gcm, e := newGCM(key)
+	if e != nil {
+		return e
+	}
+
+	m, e := gcm.Open(nil, env.Nonce, env.Message, additionalData(env))
+	if e != nil {
+		return fmt.Errorf("Cannot decrypt dlog record with key %s: %v", env.KeyID, e)
+	}
+
+	env.Message, env.KeyID, env.Nonce = m, "", nil
+	return nil
+}
+
+// additionalData returns the fields of env authenticated by AES-GCM.
+func additionalData(env *Envelope) []byte {
+	return appendMetadata(appendFrame(nil, []byte(env.KeyID)), env)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, e := aes.NewCipher(key)
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(block)
+}
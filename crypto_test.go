@@ -0,0 +1,194 @@
+package dlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeKeyring(t *testing.T, path, current string, ids ...string) {
+	keys := ""
+	for i, id := range ids {
+		if i > 0 {
+			keys += ","
+		}
+		key := make([]byte, 32)
+		copy(key, id)
+		keys += fmt.Sprintf("%q: %q", id, base64.StdEncoding.EncodeToString(key))
+	}
+	content := fmt.Sprintf(`{"current": %q, "keys": {%s}}`, current, keys)
+	if e := ioutil.WriteFile(path, []byte(content), 0600); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyring.json")
+
+	writeKeyring(t, path, "k1", "k1")
+	keys, e := NewKeyring(path)
+	assert.Nil(e)
+
+	en, e := encode(click{Session: "s"})
+	assert.Nil(e)
+	old := &Envelope{Message: en}
+	assert.Nil(encryptEnvelope(old, keys))
+	assert.Equal("k1", old.KeyID)
+	assert.NotEqual(en, old.Message)
+
+	// Rotate keys.  Records encrypted with k1 still decrypt.
+	writeKeyring(t, path, "k2", "k1", "k2")
+	assert.Nil(keys.Reload())
+	env := &Envelope{Message: en}
+	assert.Nil(encryptEnvelope(env, keys))
+	assert.Equal("k2", env.KeyID)
+
+	for _, env := range []*Envelope{old, env} {
+		assert.Nil(decryptEnvelope(env, keys))
+		assert.Equal(en, env.Message)
+		assert.Equal("", env.KeyID)
+	}
+
+	_, e = keys.Key("k3")
+	assert.True(errors.Is(e, ErrUnknownKey))
+
+	// Tampered key ID.
+	env = &Envelope{Message: en}
+	assert.Nil(encryptEnvelope(env, keys))
+	env.KeyID = "k1"
+	assert.NotNil(decryptEnvelope(env, keys))
+
+	writeKeyring(t, path, "k3", "k1")
+	assert.NotNil(keys.Reload())
+}
+
+func TestEncryptedLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyring.json")
+	writeKeyring(t, path, "k1", "k1")
+	keys, e := NewKeyring(path)
+	assert.Nil(e)
+
+	l, e := NewLogger(&click{}, &Options{
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+		EncryptionKeys: keys,
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+	RegisterType(click{})
+
+	assert.Nil(l.LogSync(context.Background(), click{Session: "secret"}))
+	assert.Nil(l.Close())
+
+	data := l.kinesis.(*kinesisMock).storage[l.streamName][0][0].Data
+	assert.False(bytes.Contains(data, []byte("secret")))
+
+	_, e = Decode("github.com-topicai-dlog.click", data)
+	assert.NotNil(e)
+
+	m, e := NewReader(&ReaderOptions{Keys: keys}).Decode("github.com-topicai-dlog.click", data)
+	assert.Nil(e)
+	assert.Equal("secret", m.(*click).Session)
+}
+
+func TestEncryptedPartitionKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keyring.json")
+	writeKeyring(t, path, "k1", "k1")
+	keys, e := NewKeyring(path)
+	assert.Nil(e)
+
+	l, e := NewLogger(&click{}, &Options{
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+		EncryptionKeys: keys,
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+	assert.Nil(l.LogSync(context.Background(), click{Session: "secret"}))
+	assert.Nil(l.LogSync(context.Background(), click{Session: "secret"}))
+	assert.Nil(l.Close())
+
+	// Keys don't tell guessed plaintexts.
+	en, e := encode(click{Session: "secret"})
+	assert.Nil(e)
+	var stored []string
+	for _, batch := range l.kinesis.(*kinesisMock).storage[l.streamName] {
+		for _, r := range batch {
+			assert.NotEqual(partitionKey(nil, en), r.PartitionKey)
+			stored = append(stored, r.PartitionKey)
+		}
+	}
+	assert.Equal(2, len(stored))
+	assert.NotEqual(stored[0], stored[1])
+
+	// Keys of PartitionKeyers are HMACs, so they keep their order.
+	l, e = NewLogger(&keyedSession{}, &Options{
+		HashKey:        []byte("secret"),
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+		EncryptionKeys: keys,
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+	assert.Nil(l.LogSync(context.Background(), keyedSession{Session: "s1"}))
+	assert.Nil(l.Close())
+
+	r := l.kinesis.(*kinesisMock).storage[l.streamName][0][0]
+	hashed := hmacHex([]byte("secret"), "s1")
+	assert.Equal(hmacHex([]byte("secret"), hashed), r.PartitionKey)
+}
+
+func TestEncryptionAuthenticatesMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keyring.json")
+	writeKeyring(t, path, "k1", "k1")
+	keys, e := NewKeyring(path)
+	assert.Nil(e)
+
+	seal := func() *Envelope {
+		env := &Envelope{SampleRate: 0.5, Transformed: map[string]string{"Session": "hash"}, Message: []byte("m")}
+		assert.Nil(encryptEnvelope(env, keys))
+		return env
+	}
+
+	env := seal()
+	assert.Nil(decryptEnvelope(env, keys))
+	assert.Equal("m", string(env.Message))
+
+	env = seal()
+	env.SampleRate = 1
+	assert.NotNil(decryptEnvelope(env, keys))
+
+	env = seal()
+	env.Transformed = nil
+	assert.NotNil(decryptEnvelope(env, keys))
+}
@@ -0,0 +1,138 @@
+package dlog
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RecordIDer is implemented by messages with their own unique IDs,
+// like click IDs, so that Reader can drop duplicates written by
+// retries of the application.
+type RecordIDer interface {
+	RecordID() string
+}
+
+func newRecordID() string {
+	b := make([]byte, 16)
+	if _, e := rand.Read(b); e != nil {
+		panic(e) // crypto/rand never fails on supported platforms.
+	}
+	return hex.EncodeToString(b)
+}
+
+// DedupFilter is the set of record IDs seen within a time window.
+// Reader drops records whose IDs are in the set.
+type DedupFilter struct {
+	window time.Duration
+	store  CheckpointStore // nil if in memory.
+	name   string
+
+	lock  sync.Mutex
+	seen  map[string]time.Time
+	order []dedupEntry // Sorted by time.
+	now   func() time.Time
+}
+
+type dedupEntry struct {
+	ID   string
+	Time time.Time
+}
+
+// NewDedupFilter returns a DedupFilter of window.  If store is not
+// nil, the filter is loaded from the state of name in store, and
+// Checkpoint saves it there.
+func NewDedupFilter(window time.Duration, store CheckpointStore, name string) (*DedupFilter, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("Dedup window must be positive, got %v", window)
+	}
+
+	f := &DedupFilter{
+		window: window,
+		store:  store,
+		name:   name,
+		seen:   make(map[string]time.Time),
+		now:    time.Now,
+	}
+
+	if store != nil {
+		data, e := store.Load(name)
+		if e != nil {
+			return nil, e
+		}
+		if data != nil {
+			if e := gob.NewDecoder(bytes.NewReader(data)).Decode(&f.order); e != nil {
+				return nil, fmt.Errorf("Cannot decode dedup filter %s: %v", name, e)
+			}
+			for _, entry := range f.order {
+				f.seen[entry.ID] = entry.Time
+			}
+		}
+	}
+	return f, nil
+}
+
+// add adds id into the set, and returns false if it was already
+// there.
+func (f *DedupFilter) add(id string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := f.now()
+	f.expire(now)
+
+	if _, ok := f.seen[id]; ok {
+		return false
+	}
+	f.seen[id] = now
+	f.order = append(f.order, dedupEntry{ID: id, Time: now})
+	return true
+}
+
+// remove removes id, so that a record that failed to be handled is
+// not dropped when it comes again.
+func (f *DedupFilter) remove(id string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.seen, id) // expire skips entries not in seen.
+}
+
+// expire requires f.lock.
+func (f *DedupFilter) expire(now time.Time) {
+	i := 0
+	for ; i < len(f.order) && now.Sub(f.order[i].Time) >= f.window; i++ {
+		if t, ok := f.seen[f.order[i].ID]; ok && t.Equal(f.order[i].Time) {
+			delete(f.seen, f.order[i].ID)
+		}
+	}
+	f.order = f.order[i:]
+}
+
+// Checkpoint saves the filter into the store.  Call it when the
+// consumer checkpoints its position in the stream, so both are
+// restored together.
+func (f *DedupFilter) Checkpoint() error {
+	if f.store == nil {
+		return nil
+	}
+
+	f.lock.Lock()
+	f.expire(f.now())
+	live := make([]dedupEntry, 0, len(f.seen))
+	for _, entry := range f.order {
+		if t, ok := f.seen[entry.ID]; ok && t.Equal(entry.Time) {
+			live = append(live, entry)
+		}
+	}
+	f.lock.Unlock()
+
+	var buf bytes.Buffer
+	if e := gob.NewEncoder(&buf).Encode(live); e != nil {
+		return e
+	}
+	return f.store.Save(f.name, buf.Bytes())
+}
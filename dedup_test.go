@@ -0,0 +1,155 @@
+package dlog
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type idClick struct {
+	ID      string
+	Element string
+}
+
+func (c idClick) RecordID() string {
+	return c.ID
+}
+
+func TestDedupFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+	store := &FileCheckpointStore{Dir: dir}
+
+	f, e := NewDedupFilter(time.Minute, store, "dedup")
+	assert.Nil(e)
+	now := time.Now()
+	f.now = func() time.Time { return now }
+
+	assert.True(f.add("a"))
+	assert.False(f.add("a"))
+	f.remove("a")
+	assert.True(f.add("a"))
+
+	now = now.Add(30 * time.Second)
+	assert.True(f.add("b"))
+	assert.Nil(f.Checkpoint())
+
+	// Restored from the checkpoint.
+	f, e = NewDedupFilter(time.Minute, store, "dedup")
+	assert.Nil(e)
+	f.now = func() time.Time { return now }
+	assert.False(f.add("a"))
+	assert.False(f.add("b"))
+
+	now = now.Add(45 * time.Second) // "a" expires.
+	assert.True(f.add("a"))
+	assert.False(f.add("b"))
+
+	_, e = NewDedupFilter(0, nil, "")
+	assert.NotNil(e)
+}
+
+func TestReaderDedup(t *testing.T) {
+	assert := assert.New(t)
+
+	l, e := NewLogger(&idClick{}, &Options{
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+	RegisterType(idClick{})
+
+	// A retry of the application writes c1 twice.
+	for _, id := range []string{"c1", "c1", "c2"} {
+		assert.Nil(l.LogSync(context.Background(), idClick{ID: id}))
+	}
+	assert.Nil(l.Close())
+
+	f, e := NewDedupFilter(time.Minute, nil, "")
+	assert.Nil(e)
+	r := NewReader(&ReaderOptions{Dedup: f})
+
+	var handled []string
+	fail := true
+	h := func(msg interface{}, env *Envelope) error {
+		if fail && env.RecordID == "c2" {
+			fail = false
+			return errors.New("handler failed")
+		}
+		handled = append(handled, msg.(*idClick).ID)
+		return nil
+	}
+
+	typeName := "github.com-topicai-dlog.idclick"
+	for _, b := range l.kinesis.(*kinesisMock).storage[l.streamName] {
+		for _, entry := range b {
+			e := r.Handle(typeName, entry.Data, h)
+			if e != nil {
+				// The consumer retries the failed record.
+				assert.Nil(r.Handle(typeName, entry.Data, h))
+			}
+		}
+	}
+	assert.Equal([]string{"c1", "c2"}, handled)
+	assert.Equal("1", r.droppedDuplicates.String())
+}
+
+// ambiguousSink keeps records, but fails the first call as if its
+// response were lost.
+type ambiguousSink struct {
+	calls   int
+	records []SinkRecord
+}
+
+func (s *ambiguousSink) Put(streamName string, records []SinkRecord) ([]error, error) {
+	s.calls++
+	s.records = append(s.records, records...)
+	if s.calls == 1 {
+		return nil, errors.New("connection reset")
+	}
+	return nil, nil
+}
+
+func TestIdempotentRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := &ambiguousSink{}
+	l, e := NewLogger(&click{}, &Options{
+		RecordIDs:        true,
+		SyncPeriod:       10 * time.Millisecond,
+		Retries:          1,
+		RetryBackoff:     time.Millisecond,
+		StreamNamePrefix: "dev",
+		Sink:             sink,
+	})
+	assert.Nil(e)
+	RegisterType(click{})
+	assert.Nil(l.LogSync(context.Background(), click{Session: "s"}))
+	assert.Nil(l.Close())
+
+	// The retry writes the same record with the same ID, which the
+	// Reader drops.
+	assert.Equal(2, len(sink.records))
+	assert.Equal(sink.records[0].Data, sink.records[1].Data)
+
+	f, e := NewDedupFilter(time.Minute, nil, "")
+	assert.Nil(e)
+	r := NewReader(&ReaderOptions{Dedup: f})
+	handled := 0
+	for _, rec := range sink.records {
+		assert.Nil(r.Handle("github.com-topicai-dlog.click", rec.Data, func(msg interface{}, env *Envelope) error {
+			handled++
+			return nil
+		}))
+	}
+	assert.Equal(1, handled)
+}
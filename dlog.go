@@ -2,17 +2,18 @@ package dlog
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"expvar"
 	"fmt"
 	"log"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/AdRoll/goamz/kinesis"
-	"github.com/topicai/candy"
 )
 
 const (
@@ -24,20 +25,60 @@ const (
 
 	// We use MD5 to compute the partitionKey.
 	partitionKeySize = 128
+
+	// Default backoff before the first retry of failed records.
+	defaultRetryBackoff = 100 * time.Millisecond
 )
 
 type Logger struct {
 	*Options
 	msgType    reflect.Type
 	streamName string
-	buffer     chan []byte
+	queue      *queue
+	pipeline   *pipeline
+	shards     *shardLimiter  // nil unless Options.ShardRateLimit.
+	sampler    *sampler       // nil unless sampling.
+	redaction  *redactionPlan // nil unless fields have dlog tags.
+	enveloped  bool           // Records are Envelopes, not plain messages.
 	kinesis    KinesisInterface
+	sink       Sink
+
+	// Every record is stamped with producerID and the next seq.
+	producerID string
+	seq        uint64
+
+	// Close closes done, then the sync goroutine flushes queued
+	// messages and closes stopped.
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
 
 	// dlog exposed runtime metrics
 	writtenRecords  *expvar.Int
 	writtenBatches  *expvar.Int
 	failedRecords   *expvar.Int
+	retriedRecords  *expvar.Int
 	tooBigMesssages *expvar.Int
+	sampledOut      *expvar.Int
+	droppedRecords  *expvar.Map // Keyed by OverflowPolicy.String().
+	spilledRecords  *expvar.Int
+	queueTime       *latency // From Log to PutRecords of each record.
+	flushLatency    *latency // Of each PutRecords call.
+	throttleTime    *latency // Batches held back by shard limits.
+
+	// Keyed by Priority.String().
+	writtenByPriority *expvar.Map
+	failedByPriority  *expvar.Map
+	droppedByPriority *expvar.Map
+}
+
+// PartitionKeyer is implemented by messages that choose their Kinesis
+// partition key.  Messages of the same key go to the same shard, and
+// Logger sends them in order.  Keys longer than 128 bytes are
+// replaced by their MD5.  Other messages use the MD5 of the encoded
+// message as the key.
+type PartitionKeyer interface {
+	PartitionKey() string
 }
 
 func NewLogger(example interface{}, opts *Options) (*Logger, error) {
@@ -46,127 +87,534 @@ func NewLogger(example interface{}, opts *Options) (*Logger, error) {
 		return nil, e
 	}
 
-	n, e := opts.streamName(example)
+	if e := registerImpls(t, opts.Implementations); e != nil {
+		return nil, e
+	}
+
+	if e := checkEncodable(t); e != nil {
+		return nil, e
+	}
+
+	smp, e := newSampler(t, example, opts)
+	if e != nil {
+		return nil, e
+	}
+
+	plan, e := redactionPlanOf(t)
 	if e != nil {
 		return nil, e
 	}
+	if plan != nil && plan.hashes() && len(opts.HashKey) == 0 {
+		return nil, fmt.Errorf("Options.HashKey mustn't be empty for dlog:\"hash\" fields of %v", t)
+	}
+	for _, impl := range opts.Implementations {
+		// Values of interface fields are transformed by their plans.
+		p, e := redactionPlanOfValue(reflect.ValueOf(impl))
+		if e != nil {
+			return nil, e
+		}
+		if p != nil && p.hashes() && len(opts.HashKey) == 0 {
+			return nil, fmt.Errorf("Options.HashKey mustn't be empty for dlog:\"hash\" fields of %T", impl)
+		}
+	}
 
-	k, e := opts.kinesis()
+	n, e := opts.streamName(example)
 	if e != nil {
 		return nil, e
 	}
 
+	// Kinesis is needed only to write into it, or to get the shard
+	// map of the stream.
+	var k KinesisInterface
+	if opts.Sink == nil || opts.ShardRateLimit || opts.UseMockKinesis {
+		if k, e = opts.kinesis(); e != nil {
+			return nil, e
+		}
+	}
+
+	var spill *spillFile
+	if opts.OverflowPolicy == SpillToDisk || len(opts.SpillDir) > 0 {
+		if spill, e = openSpillFile(opts.SpillDir, n); e != nil {
+			return nil, e
+		}
+	}
+
 	createdTime := time.Now().UnixNano()
 
 	l := &Logger{
 		Options:    opts,
 		msgType:    t,
 		streamName: n,
-		buffer:     make(chan []byte),
+		sampler:    smp,
+		redaction:  plan,
+		enveloped:  needsEnvelope(t, opts, smp != nil, plan != nil),
+		pipeline:   newPipeline(opts.MaxInFlight),
 		kinesis:    k,
+		sink:       opts.sink(k),
+		producerID: newProducerID(),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
 
 		// use createdTime as name suffix to avoid conflict
 		writtenRecords:  expvar.NewInt(fmt.Sprintf("%v--writtenRecords--%v", n, createdTime)),
 		writtenBatches:  expvar.NewInt(fmt.Sprintf("%v--writtenBatches--%v", n, createdTime)),
 		failedRecords:   expvar.NewInt(fmt.Sprintf("%v--failedRecords--%v", n, createdTime)),
+		retriedRecords:  expvar.NewInt(fmt.Sprintf("%v--retriedRecords--%v", n, createdTime)),
 		tooBigMesssages: expvar.NewInt(fmt.Sprintf("%v--tooBigMesssages--%v", n, createdTime)),
+		sampledOut:      expvar.NewInt(fmt.Sprintf("%v--sampledOut--%v", n, createdTime)),
+		droppedRecords:  expvar.NewMap(fmt.Sprintf("%v--droppedRecords--%v", n, createdTime)),
+		spilledRecords:  expvar.NewInt(fmt.Sprintf("%v--spilledRecords--%v", n, createdTime)),
+		queueTime:       &latency{},
+		flushLatency:    &latency{},
+		throttleTime:    &latency{},
+
+		writtenByPriority: expvar.NewMap(fmt.Sprintf("%v--writtenByPriority--%v", n, createdTime)),
+		failedByPriority:  expvar.NewMap(fmt.Sprintf("%v--failedByPriority--%v", n, createdTime)),
+		droppedByPriority: expvar.NewMap(fmt.Sprintf("%v--droppedByPriority--%v", n, createdTime)),
+	}
+	expvar.Publish(fmt.Sprintf("%v--queueTime--%v", n, createdTime), l.queueTime)
+	expvar.Publish(fmt.Sprintf("%v--flushLatency--%v", n, createdTime), l.flushLatency)
+	expvar.Publish(fmt.Sprintf("%v--throttleTime--%v", n, createdTime), l.throttleTime)
+	l.queue = newQueue(opts.QueueLength, opts.QueueBytes, opts.OverflowPolicy, spill, l.drop,
+		func(*record) { l.spilledRecords.Add(1) })
+
+	if opts.ShardRateLimit {
+		l.shards = newShardLimiter(opts.ShardBytesPerSecond, opts.ShardRecordsPerSecond)
+		go l.shards.refresh(k, n, opts.ShardRefreshPeriod, l.done)
 	}
 
 	go l.sync()
 	return l, nil
 }
 
+// ProducerID returns the unique ID of the Logger, which is written
+// into every record with a sequence number, so that Reader can detect
+// lost, duplicate and reordered records.
+func (l *Logger) ProducerID() string {
+	return l.producerID
+}
+
+// Log encodes msg and writes it into the queue, from where the sync
+// goroutine sends it to Kinesis.  Errors returned match one of
+// ErrWrongType, ErrEncode, ErrMessageTooLarge, ErrWriteTimeout,
+// ErrDropped and ErrClosed.
 func (l *Logger) Log(msg interface{}) error {
-	if t, e := msgType(msg); e != nil {
+	return l.LogContext(context.Background(), msg)
+}
+
+// LogContext is like Log, but it gives up writing into the queue
+// once ctx is done, and returns ctx.Err().  The write waits for at
+// most Options.WriteTimeout or until the deadline of ctx, whichever
+// is earlier.
+func (l *Logger) LogContext(ctx context.Context, msg interface{}) error {
+	_, e := l.write(ctx, msg, false)
+	return e
+}
+
+// LogSync is like LogContext, but it also waits until the batch
+// including msg has been sent to Kinesis, and returns the error, if
+// any, of sending msg.  If ctx is done before that, LogSync returns
+// ctx.Err(), but msg might still be sent later.
+func (l *Logger) LogSync(ctx context.Context, msg interface{}) error {
+	r, e := l.write(ctx, msg, true)
+	if e != nil || r == nil { // r is nil if msg is sampled out.
 		return e
+	}
+
+	select {
+	case e := <-r.sent:
+		return e
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// record is an enveloped message in the queue.  If sent isn't nil,
+// flush reports to it the result of sending the record.
+type record struct {
+	data     []byte
+	key      string
+	priority Priority
+	enqueued time.Time
+	order    uint64 // Set by the queue.
+	sent     chan error
+
+	heartbeat bool // Not counted in metrics of records.
+}
+
+func (l *Logger) write(ctx context.Context, msg interface{}, wait bool) (*record, error) {
+	if t, e := msgType(msg); e != nil {
+		return nil, e
 	} else if !t.AssignableTo(l.msgType) {
-		return fmt.Errorf("parameter (%+v) not assignable to %v", msg, l.msgType)
+		return nil, &WrongTypeError{Got: t, Want: l.msgType}
+	}
+
+	// Check before select, which chooses randomly among ready cases.
+	if e := ctx.Err(); e != nil {
+		return nil, e
+	}
+	select {
+	case <-l.done:
+		return nil, ErrClosed
+	default:
 	}
 
 	var timeout <-chan time.Time // Receiving from nil channel blocks forever.
 	if l.WriteTimeout > 0 {
-		timeout = time.After(l.WriteTimeout)
+		t := time.NewTimer(l.WriteTimeout)
+		defer t.Stop()
+		timeout = t.C
 	}
 
-	en := encode(msg)
-	if (len(en) + partitionKeySize) > maxMessageSize {
+	encoded, transformed := msg, map[string]string(nil)
+	if l.redaction != nil {
+		encoded, transformed = l.redaction.apply(msg, l.HashKey)
+	}
+
+	en, e := encode(encoded)
+	if e != nil {
+		return nil, e
+	}
+
+	if l.sampler != nil && !l.sampler.keep(msg, en) {
+		l.sampledOut.Add(1)
+		return nil, nil
+	}
+
+	data := en
+	if l.enveloped {
+		env := l.envelope(en)
+		if len(transformed) > 0 {
+			env.Transformed = transformed
+		}
+		if id, ok := msg.(RecordIDer); ok {
+			env.RecordID = id.RecordID()
+		} else if l.RecordIDs {
+			env.RecordID = newRecordID()
+		}
+		if data, e = l.seal(env); e != nil {
+			return nil, e
+		}
+	}
+
+	if (len(data) + partitionKeySize) > maxMessageSize {
 		l.tooBigMesssages.Add(1)
-		return fmt.Errorf("Size of gob-encoded message plus partition key larger than %d bytes", maxMessageSize)
-	} else {
+		return nil, &MessageTooLargeError{Size: len(data) + partitionKeySize, Limit: maxMessageSize}
+	}
+
+	key := partitionKey(encoded, en)
+	if l.EncryptionKeys != nil {
+		key = l.encryptedPartitionKey(encoded, data)
+	}
+
+	r := &record{
+		data:     data,
+		key:      key,
+		priority: priority(ctx, msg, l.Priority),
+		enqueued: time.Now(),
+	}
+	if wait {
+		r.sent = make(chan error, 1)
+	}
+
+	for {
+		wait, e := l.queue.push(r)
+		if e != nil {
+			return nil, e
+		} else if wait == nil {
+			return r, nil
+		}
+
 		select {
-		case l.buffer <- en:
+		case <-wait:
 		case <-timeout:
-			return fmt.Errorf("dlog writes %+v timeout after %v", msg, l.WriteTimeout)
+			l.droppedRecords.Add(Block.String(), 1)
+			l.droppedByPriority.Add(r.priority.String(), 1)
+			return nil, fmt.Errorf("%w after %v", ErrWriteTimeout, l.WriteTimeout)
+		case <-ctx.Done():
+			l.droppedRecords.Add(Block.String(), 1)
+			l.droppedByPriority.Add(r.priority.String(), 1)
+			return nil, ctx.Err()
+		case <-l.done:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// envelope returns the envelope of the gob-encoded message en.
+func (l *Logger) envelope(en []byte) *Envelope {
+	env := &Envelope{
+		ProducerID: l.producerID,
+		Seq:        atomic.AddUint64(&l.seq, 1),
+		Message:    en,
+	}
+	if l.sampler != nil {
+		env.SampleRate = l.sampler.rate
+	}
+	return env
+}
+
+// seal encrypts and signs env, if configured, and encodes it.
+func (l *Logger) seal(env *Envelope) ([]byte, error) {
+	if l.EncryptionKeys != nil {
+		if e := encryptEnvelope(env, l.EncryptionKeys); e != nil {
+			return nil, &EncodeError{Type: l.msgType, Err: e}
 		}
 	}
-	return nil
+	if l.SigningKeys != nil {
+		if e := signEnvelope(env, l.SigningKeys); e != nil {
+			return nil, &EncodeError{Type: l.msgType, Err: e}
+		}
+	}
+	return sealEnvelope(env)
+}
+
+// drop counts a record dropped by the overflow policy, and tells
+// LogSync waiting for it.
+func (l *Logger) drop(r *record) {
+	l.droppedRecords.Add(l.OverflowPolicy.String(), 1)
+	l.droppedByPriority.Add(r.priority.String(), 1)
+	if r.sent != nil {
+		r.sent <- ErrDropped
+	}
 }
 
-func encode(v interface{}) []byte {
+// Close stops the Logger after sending queued messages to Kinesis.
+// Log calls after Close return ErrClosed, and so does a second Close.
+func (l *Logger) Close() error {
+	e := ErrClosed
+	l.closeOnce.Do(func() {
+		l.queue.close()
+		close(l.done)
+		<-l.stopped
+		e = nil
+	})
+	return e
+}
+
+// encode returns the gob encoding of v.  Errors, like those caused by
+// unregistered types behind interface fields, and panics in custom
+// GobEncode methods are returned as *EncodeError.
+func encode(v interface{}) (en []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			en, err = nil, &EncodeError{Type: reflect.TypeOf(v), Err: fmt.Errorf("%v", r)}
+		}
+	}()
+
 	var buf bytes.Buffer
-	candy.Must(gob.NewEncoder(&buf).Encode(v)) // Very rare case of errors.
-	return buf.Bytes()
+	if e := gob.NewEncoder(&buf).Encode(v); e != nil {
+		return nil, &EncodeError{Type: reflect.TypeOf(v), Err: e}
+	}
+	return buf.Bytes(), nil
 }
 
 func (l *Logger) sync() {
-	if l.SyncPeriod <= 0 {
-		l.SyncPeriod = time.Second
-	}
-	ticker := time.NewTicker(l.SyncPeriod)
+	defer close(l.stopped)
 
-	buf := make([][]byte, 0)
+	trigger := newBatchTrigger(l.Options)
+	buf := make([]*record, 0)
 	bufSize := 0
 
+	var age *time.Timer
+	var aged <-chan time.Time // Receiving from nil channel blocks forever.
+
+	var heartbeat <-chan time.Time
+	if l.HeartbeatPeriod > 0 {
+		ticker := time.NewTicker(l.HeartbeatPeriod)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	flush := func() {
+		if age != nil {
+			age.Stop()
+			age, aged = nil, nil
+		}
+		if len(buf) > 0 {
+			trigger.adapt(len(buf), bufSize)
+			l.flush(&buf, &bufSize)
+		}
+	}
+
+	// drain moves queued records into buf, and flushes buf once it is
+	// full.
+	drain := func() {
+		for r := l.queue.pop(); r != nil; r = l.queue.pop() {
+			size := len(r.data) + partitionKeySize
+			if !trigger.fits(len(buf), bufSize, size) {
+				flush()
+			}
+
+			buf = append(buf, r)
+			bufSize += size
+			if len(buf) == 1 {
+				age = time.NewTimer(trigger.linger)
+				aged = age.C
+			}
+
+			if trigger.full(len(buf), bufSize) {
+				flush()
+			}
+		}
+	}
+
 	for {
 		select {
-		case msg := <-l.buffer:
-			if bufSize+len(msg)+partitionKeySize >= maxBatchSize {
-				l.flush(&buf, &bufSize)
-			}
+		case <-l.queue.ready:
+			drain()
+
+		case <-aged:
+			age, aged = nil, nil
+			flush()
 
-			buf = append(buf, msg)
-			bufSize += len(msg) + partitionKeySize
+		case <-heartbeat:
+			l.heartbeat()
+			drain()
 
-		case <-ticker.C:
-			if bufSize > 0 {
-				l.flush(&buf, &bufSize)
+		case <-l.done:
+			drain()
+			flush()
+			l.pipeline.wait()
+			if l.queue.spill != nil {
+				if e := l.queue.spill.close(); e != nil {
+					log.Printf("dlog cannot close spill file: %v", e)
+				}
 			}
+			return
 		}
 	}
 }
 
-func (l *Logger) flush(buf *[][]byte, bufSize *int) {
+// flush sends records in buf to Kinesis in a new goroutine, after
+// the pipeline allows, and resets buf and bufSize.
+func (l *Logger) flush(buf *[]*record, bufSize *int) {
+	records := *buf
+	keys := make(map[string]bool, len(records))
+	for _, r := range records {
+		keys[r.key] = true
+	}
+
+	l.pipeline.acquire(keys)
+	go func() {
+		defer l.pipeline.release(keys)
+		l.put(records)
+	}()
+
+	*buf = make([]*record, 0, len(records))
+	*bufSize = 0
+}
+
+func (l *Logger) put(records []*record) {
+	if l.shards != nil {
+		if wait := l.shards.reserve(records); wait > 0 {
+			l.throttleTime.observe(wait)
+			time.Sleep(wait)
+		}
+	}
 
-	entries := make([]kinesis.PutRecordsRequestEntry, 0, len(*buf))
-	for _, msg := range *buf {
-		entries = append(entries, kinesis.PutRecordsRequestEntry{
-			Data:         msg,
-			PartitionKey: partitionKey(msg),
-		})
+	now := time.Now()
+	for _, r := range records {
+		l.queueTime.observe(now.Sub(r.enqueued))
 	}
+	errs := l.putRetrying(records)
 
-	resp, e := l.kinesis.PutRecords(l.streamName, entries)
-	if e == nil {
-		if resp.FailedRecordCount > 0 {
-			log.Printf("PutRecords some records failed: %+v", resp)
+	for i, r := range records {
+		err := errs[i]
+		switch {
+		case r.heartbeat:
+		case err != nil:
+			l.failedRecords.Add(1)
+			l.failedByPriority.Add(r.priority.String(), 1)
+		default:
+			l.writtenRecords.Add(1)
+			l.writtenByPriority.Add(r.priority.String(), 1)
 		}
 
-		l.writtenBatches.Add(1)
-		l.writtenRecords.Add(int64(len(entries) - resp.FailedRecordCount))
-		l.failedRecords.Add(int64(resp.FailedRecordCount))
+		if r.sent != nil {
+			r.sent <- err
+		}
+	}
+}
 
-	} else {
-		log.Printf("PutRecords failed: %v", e)
+// putRetrying writes records into the sink, and retries failed
+// records up to Options.Retries times.  It returns the error of each
+// record, which is nil if the record was written.
+func (l *Logger) putRetrying(records []*record) []error {
+	errs := make([]error, len(records))
+	pending := make([]int, len(records)) // Indexes of records to write.
+	for i := range pending {
+		pending[i] = i
+	}
 
-		l.failedRecords.Add(int64(len(entries)))
+	backoff := l.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
 	}
 
-	// reset buf and bufSize
-	*buf = (*buf)[0:0]
-	*bufSize = 0
+	for retry := 0; ; retry++ {
+		batch := make([]SinkRecord, 0, len(pending))
+		for _, i := range pending {
+			batch = append(batch, SinkRecord{Data: records[i].data, PartitionKey: records[i].key})
+		}
+
+		start := time.Now()
+		failed, e := l.sink.Put(l.streamName, batch)
+		l.flushLatency.observe(time.Since(start))
+		if e != nil {
+			log.Printf("dlog sink failed: %v", e)
+		} else {
+			l.writtenBatches.Add(1)
+		}
+
+		var retryable []int
+		for j, i := range pending {
+			err := e
+			if err == nil && j < len(failed) {
+				err = failed[j]
+			}
+			errs[i] = err
+			if err != nil && !errors.Is(err, ErrMessageTooLarge) {
+				retryable = append(retryable, i)
+			}
+		}
+
+		if len(retryable) == 0 || retry >= l.Retries {
+			return errs
+		}
+		l.retriedRecords.Add(int64(len(retryable)))
+		time.Sleep(backoff)
+		backoff *= 2
+		pending = retryable
+	}
 }
 
-func partitionKey(data []byte) string {
+// partitionKey returns the key of msg if it is a PartitionKeyer, or
+// the MD5 of its encoding data otherwise.  msg is the message after
+// redaction, so keys of dlog:"hash" fields are hashed.
+func partitionKey(msg interface{}, data []byte) string {
+	if k, ok := msg.(PartitionKeyer); ok {
+		key := k.PartitionKey()
+		if len(key) > 0 && len(key) <= partitionKeySize {
+			return key
+		}
+		data = []byte(key)
+	}
+
 	m := md5.Sum(data)
 	return hex.EncodeToString(m[:])
 }
+
+// encryptedPartitionKey returns the partition key of an encrypted
+// record, which mustn't reveal the message: the HMAC of the key of a
+// PartitionKeyer keyed by Options.HashKey, so that messages of the
+// same key stay in order, or otherwise the MD5 of the ciphertext,
+// which is random.
+func (l *Logger) encryptedPartitionKey(msg interface{}, data []byte) string {
+	if k, ok := msg.(PartitionKeyer); ok && len(l.HashKey) > 0 {
+		if key := k.PartitionKey(); len(key) > 0 {
+			return hmacHex(l.HashKey, key)
+		}
+	}
+	return partitionKey(nil, data)
+}
@@ -0,0 +1,150 @@
+// Package dlogtest provides a fake Kinesis server for tests of dlog,
+// which speaks the JSON-over-HTTP protocol of Kinesis, so that tests
+// exercise real Kinesis clients offline.
+package dlogtest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/AdRoll/goamz/kinesis"
+	"github.com/topicai/dlog"
+)
+
+const targetPrefix = "Kinesis_20131202."
+
+// Server is a fake Kinesis on an httptest.Server, backed by a
+// dlog.KinesisEmulator in a temporary directory.  It implements
+// CreateStream, DeleteStream, DescribeStream, ListShards, PutRecords,
+// GetShardIterator and GetRecords.  Requests must be signed, but
+// signatures are not verified.
+type Server struct {
+	*httptest.Server
+	Kinesis *dlog.KinesisEmulator
+	dir     string
+}
+
+// NewServer starts a Server.  Close stops it and removes its records.
+func NewServer() (*Server, error) {
+	dir, e := ioutil.TempDir("", "dlogtest")
+	if e != nil {
+		return nil, e
+	}
+
+	k, e := dlog.NewKinesisEmulator(dir)
+	if e != nil {
+		os.RemoveAll(dir)
+		return nil, e
+	}
+
+	s := &Server{Kinesis: k, dir: dir}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s, nil
+}
+
+func (s *Server) Close() {
+	s.Server.Close()
+	s.Kinesis.Close()
+	os.RemoveAll(s.dir)
+}
+
+// apiError is the body of error responses.
+type apiError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "InvalidAction", "Method "+r.Method+" not allowed")
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256") {
+		writeError(w, http.StatusBadRequest, "MissingAuthenticationTokenException", "Request is not signed")
+		return
+	}
+
+	target := r.Header.Get("X-Amz-Target")
+	if !strings.HasPrefix(target, targetPrefix) {
+		writeError(w, http.StatusBadRequest, "UnknownOperationException", "Unknown target "+target)
+		return
+	}
+
+	resp, e := s.call(strings.TrimPrefix(target, targetPrefix), r)
+	if e != nil {
+		var ke *kinesis.Error
+		if errors.As(e, &ke) {
+			writeError(w, http.StatusBadRequest, ke.Code, ke.Message)
+		} else {
+			writeError(w, http.StatusInternalServerError, "InternalFailure", e.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Type: code, Message: message})
+}
+
+// request has fields of requests of all actions.
+type request struct {
+	StreamName             string
+	ShardCount             int
+	Records                []kinesis.PutRecordsRequestEntry
+	ShardId                string
+	ShardIteratorType      kinesis.ShardIteratorType
+	StartingSequenceNumber string
+	ShardIterator          string
+	Limit                  int
+}
+
+func (s *Server) call(action string, r *http.Request) (interface{}, error) {
+	var req request
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, &kinesis.Error{StatusCode: 400, Code: "SerializationException", Message: e.Error()}
+	}
+
+	switch action {
+	case "CreateStream":
+		return struct{}{}, s.Kinesis.CreateStream(req.StreamName, req.ShardCount)
+
+	case "DeleteStream":
+		return struct{}{}, s.Kinesis.DeleteStream(req.StreamName)
+
+	case "DescribeStream":
+		desc, e := s.Kinesis.DescribeStream(req.StreamName)
+		if e != nil {
+			return nil, e
+		}
+		desc.StreamARN = fmt.Sprintf("arn:aws:kinesis:us-east-1:000000000000:stream/%s", req.StreamName)
+		return struct{ StreamDescription *kinesis.StreamDescription }{desc}, nil
+
+	case "ListShards":
+		desc, e := s.Kinesis.DescribeStream(req.StreamName)
+		if e != nil {
+			return nil, e
+		}
+		return struct{ Shards []kinesis.Shard }{desc.Shards}, nil
+
+	case "PutRecords":
+		return s.Kinesis.PutRecords(req.StreamName, req.Records)
+
+	case "GetShardIterator":
+		return s.Kinesis.GetShardIterator(req.ShardId, req.StreamName, req.ShardIteratorType, req.StartingSequenceNumber)
+
+	case "GetRecords":
+		return s.Kinesis.GetRecords(req.ShardIterator, req.Limit)
+	}
+	return nil, &kinesis.Error{StatusCode: 400, Code: "UnknownOperationException", Message: "Unknown action " + action}
+}
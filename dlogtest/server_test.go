@@ -0,0 +1,159 @@
+package dlogtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/kinesis"
+	"github.com/stretchr/testify/assert"
+	"github.com/topicai/dlog"
+)
+
+// call posts a request like a Kinesis client, and decodes the response
+// into resp.  It returns the HTTP status.
+func call(t *testing.T, s *Server, action string, req, resp interface{}) int {
+	body, e := json.Marshal(req)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	r, _ := http.NewRequest("POST", s.URL+"/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	r.Header.Set("X-Amz-Target", targetPrefix+action)
+	r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=test")
+
+	hresp, e := http.DefaultClient.Do(r)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer hresp.Body.Close()
+
+	if e := json.NewDecoder(hresp.Body).Decode(resp); e != nil {
+		t.Fatal(e)
+	}
+	return hresp.StatusCode
+}
+
+func TestServer(t *testing.T) {
+	assert := assert.New(t)
+
+	s, e := NewServer()
+	assert.Nil(e)
+	defer s.Close()
+
+	var empty struct{}
+	assert.Equal(200, call(t, s, "CreateStream", map[string]interface{}{"StreamName": "s", "ShardCount": 2}, &empty))
+
+	var apiErr apiError
+	assert.Equal(400, call(t, s, "CreateStream", map[string]interface{}{"StreamName": "s", "ShardCount": 2}, &apiErr))
+	assert.Equal("ResourceInUseException", apiErr.Type)
+
+	var desc struct{ StreamDescription kinesis.StreamDescription }
+	assert.Equal(200, call(t, s, "DescribeStream", map[string]string{"StreamName": "s"}, &desc))
+	assert.Equal(kinesis.StreamStatusActive, desc.StreamDescription.StreamStatus)
+	assert.Equal(2, len(desc.StreamDescription.Shards))
+
+	var shards struct{ Shards []kinesis.Shard }
+	assert.Equal(200, call(t, s, "ListShards", map[string]string{"StreamName": "s"}, &shards))
+	assert.Equal(desc.StreamDescription.Shards, shards.Shards)
+
+	var put kinesis.PutRecordsResponse
+	assert.Equal(200, call(t, s, "PutRecords", map[string]interface{}{
+		"StreamName": "s",
+		"Records": []map[string]interface{}{
+			{"Data": []byte("a"), "PartitionKey": "k"},
+			{"Data": []byte("b"), "PartitionKey": "k"},
+		},
+	}, &put))
+	assert.Equal(2, len(put.Records))
+	shard := put.Records[0].ShardId
+
+	var it kinesis.GetShardIteratorResponse
+	assert.Equal(200, call(t, s, "GetShardIterator", map[string]string{
+		"StreamName":        "s",
+		"ShardId":           shard,
+		"ShardIteratorType": "TRIM_HORIZON",
+	}, &it))
+
+	var records kinesis.GetRecordsResponse
+	assert.Equal(200, call(t, s, "GetRecords", map[string]interface{}{"ShardIterator": it.ShardIterator, "Limit": 1}, &records))
+	assert.Equal(1, len(records.Records))
+	assert.Equal("a", string(records.Records[0].Data))
+	assert.Equal(put.Records[0].SequenceNumber, records.Records[0].SequenceNumber)
+
+	assert.Equal(200, call(t, s, "GetRecords", map[string]interface{}{"ShardIterator": records.NextShardIterator}, &records))
+	assert.Equal("b", string(records.Records[0].Data))
+
+	assert.Equal(400, call(t, s, "DescribeStream", map[string]string{"StreamName": "missing"}, &apiErr))
+	assert.Equal("ResourceNotFoundException", apiErr.Type)
+	assert.Equal(400, call(t, s, "MergeShards", map[string]string{"StreamName": "s"}, &apiErr))
+	assert.Equal("UnknownOperationException", apiErr.Type)
+}
+
+type click struct {
+	Element string
+}
+
+func TestServerWithKinesisClient(t *testing.T) {
+	assert := assert.New(t)
+
+	s, e := NewServer()
+	assert.Nil(e)
+	defer s.Close()
+
+	// Logger and goamz sign and send requests to Server, as they would
+	// to Kinesis.
+	k := kinesis.New(aws.Auth{AccessKey: "test", SecretKey: "test"},
+		aws.Region{Name: "us-east-1", KinesisEndpoint: s.URL})
+	stream := "testing--github.com-topicai-dlog-dlogtest.click"
+	assert.Nil(k.CreateStream(stream, 2))
+
+	dlog.RegisterType(click{})
+	l, e := dlog.NewLogger(&click{}, &dlog.Options{
+		AccessKey:        "test",
+		SecretKey:        "test",
+		Endpoint:         s.URL,
+		StreamNamePrefix: "testing",
+		SyncPeriod:       10 * time.Millisecond,
+	})
+	assert.Nil(e)
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		assert.Nil(l.LogSync(context.Background(), click{Element: strconv.Itoa(i)}))
+		want = append(want, strconv.Itoa(i))
+	}
+	assert.Nil(l.Close())
+
+	desc, e := k.DescribeStream(stream)
+	assert.Nil(e)
+
+	r := dlog.NewReader(nil)
+	var elements []string
+	for _, shard := range desc.Shards {
+		it, e := k.GetShardIterator(shard.ShardId, stream, kinesis.ShardIteratorTrimHorizon, "")
+		assert.Nil(e)
+
+		records, e := k.GetRecords(it.ShardIterator, 0)
+		assert.Nil(e)
+		for _, rec := range records.Records {
+			assert.Nil(r.Handle("github.com-topicai-dlog-dlogtest.click", rec.Data, func(msg interface{}, env *dlog.Envelope) error {
+				elements = append(elements, msg.(*click).Element)
+				return nil
+			}))
+		}
+	}
+	sort.Strings(want)
+	sort.Strings(elements)
+	assert.Equal(want, elements)
+
+	_, e = k.DescribeStream("missing")
+	assert.NotNil(e)
+}
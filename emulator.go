@@ -0,0 +1,429 @@
+package dlog
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AdRoll/goamz/kinesis"
+)
+
+const (
+	// Limits of Kinesis PutRecords and GetRecords.
+	maxPutRecords = 500
+	maxGetRecords = 10000
+
+	emulatorMetaFile = "stream.json"
+	emulatorShardExt = ".log"
+)
+
+// KinesisReaderInterface is the read path of Kinesis, which
+// *kinesis.Kinesis and KinesisEmulator implement.
+type KinesisReaderInterface interface {
+	GetShardIterator(shardId, streamName string, iteratorType kinesis.ShardIteratorType,
+		startingSequenceNumber string) (*kinesis.GetShardIteratorResponse, error)
+	GetRecords(shardIterator string, limit int) (*kinesis.GetRecordsResponse, error)
+}
+
+// KinesisEmulator is a Kinesis of local files for development, so that
+// producers and consumers of dlog run together without AWS.  Each
+// stream is a directory with a log file of each shard, where records
+// are routed by the MD5 of partition keys, like Kinesis does.
+// Sequence numbers are the index of the record in its shard followed
+// by the shard index, so they increase within a shard.  Resharding is
+// not supported.
+type KinesisEmulator struct {
+	dir string
+
+	lock    sync.Mutex
+	streams map[string]*emulatedStream
+}
+
+type emulatedStream struct {
+	dir    string
+	shards []*emulatedShard
+}
+
+type emulatedShard struct {
+	f       *os.File
+	offsets []int64 // Of each record, followed by the end of the file.
+}
+
+type emulatedStreamMeta struct {
+	ShardCount int
+}
+
+// NewKinesisEmulator opens the emulator in dir, including streams
+// created by earlier runs.
+func NewKinesisEmulator(dir string) (*KinesisEmulator, error) {
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		return nil, e
+	}
+
+	k := &KinesisEmulator{dir: dir, streams: make(map[string]*emulatedStream)}
+	entries, e := ioutil.ReadDir(dir)
+	if e != nil {
+		return nil, e
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		s, e := openEmulatedStream(filepath.Join(dir, entry.Name()))
+		if e != nil {
+			k.Close()
+			return nil, e
+		}
+		k.streams[entry.Name()] = s
+	}
+	return k, nil
+}
+
+func openEmulatedStream(dir string) (*emulatedStream, error) {
+	content, e := ioutil.ReadFile(filepath.Join(dir, emulatorMetaFile))
+	if e != nil {
+		return nil, e
+	}
+	var meta emulatedStreamMeta
+	if e := json.Unmarshal(content, &meta); e != nil {
+		return nil, fmt.Errorf("Cannot parse %s: %v", filepath.Join(dir, emulatorMetaFile), e)
+	}
+
+	s := &emulatedStream{dir: dir}
+	for i := 0; i < meta.ShardCount; i++ {
+		shard, e := openEmulatedShard(filepath.Join(dir, shardID(i)+emulatorShardExt))
+		if e != nil {
+			s.close()
+			return nil, e
+		}
+		s.shards = append(s.shards, shard)
+	}
+	return s, nil
+}
+
+// openEmulatedShard opens the log of a shard, and truncates a partial
+// record at its tail.
+func openEmulatedShard(path string) (*emulatedShard, error) {
+	f, e := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if e != nil {
+		return nil, e
+	}
+
+	shard := &emulatedShard{f: f, offsets: []int64{0}}
+	for {
+		end := shard.offsets[len(shard.offsets)-1]
+		_, _, size, e := readEmulatedRecord(io.NewSectionReader(f, end, 1<<62))
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			if e := f.Truncate(end); e != nil {
+				f.Close()
+				return nil, e
+			}
+			break
+		}
+		shard.offsets = append(shard.offsets, end+size)
+	}
+	return shard, nil
+}
+
+func shardID(i int) string {
+	return fmt.Sprintf("shardId-%012d", i)
+}
+
+// Close closes the files of all streams.
+func (k *KinesisEmulator) Close() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	for _, s := range k.streams {
+		s.close()
+	}
+	k.streams = make(map[string]*emulatedStream)
+	return nil
+}
+
+func (s *emulatedStream) close() {
+	for _, shard := range s.shards {
+		shard.f.Close()
+	}
+}
+
+func (k *KinesisEmulator) CreateStream(name string, shardCount int) error {
+	if !streamNameRegexp.MatchString(name) {
+		return emulatorError("ValidationException", "Invalid stream name %s", name)
+	}
+	if shardCount <= 0 {
+		return emulatorError("InvalidArgumentException", "Invalid shard count %d", shardCount)
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if _, ok := k.streams[name]; ok {
+		return emulatorError("ResourceInUseException", "Stream %s already exists", name)
+	}
+
+	dir := filepath.Join(k.dir, name)
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		return e
+	}
+	meta, _ := json.Marshal(emulatedStreamMeta{ShardCount: shardCount})
+	if e := ioutil.WriteFile(filepath.Join(dir, emulatorMetaFile), meta, 0644); e != nil {
+		return e
+	}
+
+	s, e := openEmulatedStream(dir)
+	if e != nil {
+		return e
+	}
+	k.streams[name] = s
+	return nil
+}
+
+func (k *KinesisEmulator) DeleteStream(name string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	s, e := k.stream(name)
+	if e != nil {
+		return e
+	}
+	s.close()
+	delete(k.streams, name)
+	return os.RemoveAll(s.dir)
+}
+
+func (k *KinesisEmulator) DescribeStream(name string) (*kinesis.StreamDescription, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	s, e := k.stream(name)
+	if e != nil {
+		return nil, e
+	}
+	return &kinesis.StreamDescription{
+		Shards:       evenShards(len(s.shards)),
+		StreamName:   name,
+		StreamStatus: kinesis.StreamStatusActive,
+	}, nil
+}
+
+func (k *KinesisEmulator) PutRecords(streamName string, records []kinesis.PutRecordsRequestEntry) (*kinesis.PutRecordsResponse, error) {
+	if len(records) == 0 || len(records) > maxPutRecords {
+		return nil, emulatorError("InvalidArgumentException", "PutRecords of %d records", len(records))
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	s, e := k.stream(streamName)
+	if e != nil {
+		return nil, e
+	}
+
+	// Check every record before appending any, so that an invalid
+	// record fails the request without writing the others.
+	hashes := make([]*big.Int, len(records))
+	for j, r := range records {
+		if len(r.Data)+len(r.PartitionKey) > maxMessageSize || len(r.PartitionKey) == 0 ||
+			len(r.PartitionKey) > partitionKeySize {
+			return nil, emulatorError("InvalidArgumentException", "Invalid record of partition key %q and %d bytes",
+				r.PartitionKey, len(r.Data))
+		}
+
+		hashes[j] = partitionKeyHash(r.PartitionKey)
+		if len(r.ExplicitHashKey) > 0 {
+			var ok bool
+			hashes[j], ok = new(big.Int).SetString(r.ExplicitHashKey, 10)
+			if !ok || hashes[j].Sign() < 0 || hashes[j].BitLen() > 128 {
+				return nil, emulatorError("InvalidArgumentException", "Invalid explicit hash key %s", r.ExplicitHashKey)
+			}
+		}
+	}
+
+	resp := &kinesis.PutRecordsResponse{}
+	for j, r := range records {
+		i := int(evenShard(hashes[j], int32(len(s.shards))))
+		seq, e := s.shards[i].append(i, r.PartitionKey, r.Data)
+		if e != nil {
+			return nil, e
+		}
+		resp.Records = append(resp.Records, kinesis.PutRecordsResultEntry{SequenceNumber: seq, ShardId: shardID(i)})
+	}
+	return resp, nil
+}
+
+func (k *KinesisEmulator) GetShardIterator(shardId, streamName string, iteratorType kinesis.ShardIteratorType,
+	startingSequenceNumber string) (*kinesis.GetShardIteratorResponse, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	s, e := k.stream(streamName)
+	if e != nil {
+		return nil, e
+	}
+	i, shard, e := s.shard(shardId)
+	if e != nil {
+		return nil, e
+	}
+
+	var index int
+	switch iteratorType {
+	case kinesis.ShardIteratorTrimHorizon:
+		index = 0
+	case kinesis.ShardIteratorLatest:
+		index = shard.len()
+	case kinesis.ShardIteratorAtSequenceNumber, kinesis.ShardIteratorAfterSequenceNumber:
+		seqIndex, seqShard, ok := parseSequenceNumber(startingSequenceNumber)
+		if !ok || seqShard != i || seqIndex >= shard.len() {
+			return nil, emulatorError("InvalidArgumentException", "Invalid sequence number %s of shard %s",
+				startingSequenceNumber, shardId)
+		}
+		index = seqIndex
+		if iteratorType == kinesis.ShardIteratorAfterSequenceNumber {
+			index++
+		}
+	default:
+		return nil, emulatorError("InvalidArgumentException", "Unsupported shard iterator type %s", iteratorType)
+	}
+
+	return &kinesis.GetShardIteratorResponse{ShardIterator: shardIteratorString(streamName, i, index)}, nil
+}
+
+func (k *KinesisEmulator) GetRecords(shardIterator string, limit int) (*kinesis.GetRecordsResponse, error) {
+	streamName, i, index, ok := parseShardIterator(shardIterator)
+	if !ok {
+		return nil, emulatorError("InvalidArgumentException", "Invalid shard iterator %s", shardIterator)
+	}
+	if limit <= 0 || limit > maxGetRecords {
+		limit = maxGetRecords
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	s, e := k.stream(streamName)
+	if e != nil {
+		return nil, e
+	}
+	if i >= len(s.shards) {
+		return nil, emulatorError("ResourceNotFoundException", "Shard %s not found", shardID(i))
+	}
+	shard := s.shards[i]
+
+	resp := &kinesis.GetRecordsResponse{}
+	for ; index < shard.len() && len(resp.Records) < limit; index++ {
+		key, data, e := shard.read(index)
+		if e != nil {
+			return nil, e
+		}
+		resp.Records = append(resp.Records, kinesis.Record{
+			Data:           data,
+			PartitionKey:   key,
+			SequenceNumber: sequenceNumber(index, i),
+		})
+	}
+	resp.NextShardIterator = shardIteratorString(streamName, i, index)
+	return resp, nil
+}
+
+// stream requires k.lock.
+func (k *KinesisEmulator) stream(name string) (*emulatedStream, error) {
+	s, ok := k.streams[name]
+	if !ok {
+		return nil, emulatorError("ResourceNotFoundException", "Stream %s not found", name)
+	}
+	return s, nil
+}
+
+func (s *emulatedStream) shard(id string) (int, *emulatedShard, error) {
+	for i, shard := range s.shards {
+		if shardID(i) == id {
+			return i, shard, nil
+		}
+	}
+	return 0, nil, emulatorError("ResourceNotFoundException", "Shard %s not found", id)
+}
+
+func (shard *emulatedShard) len() int {
+	return len(shard.offsets) - 1
+}
+
+// append writes a record, which is a frame of the partition key
+// followed by a frame of the data, and returns its sequence number.
+func (shard *emulatedShard) append(i int, key string, data []byte) (string, error) {
+	buf := appendFrame(appendFrame(nil, []byte(key)), data)
+	end := shard.offsets[len(shard.offsets)-1]
+	if _, e := shard.f.WriteAt(buf, end); e != nil {
+		return "", e
+	}
+
+	shard.offsets = append(shard.offsets, end+int64(len(buf)))
+	return sequenceNumber(shard.len()-1, i), nil
+}
+
+func (shard *emulatedShard) read(index int) (key string, data []byte, e error) {
+	start, end := shard.offsets[index], shard.offsets[index+1]
+	k, data, _, e := readEmulatedRecord(io.NewSectionReader(shard.f, start, end-start))
+	return string(k), data, e
+}
+
+// readEmulatedRecord returns the partition key, the data and the size
+// of the record.
+func readEmulatedRecord(r io.Reader) (key, data []byte, size int64, e error) {
+	if key, e = readFrame(r); e != nil {
+		return nil, nil, 0, e
+	}
+	if data, e = readFrame(r); e != nil {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return nil, nil, 0, e
+	}
+	return key, data, int64(2*frameHeaderSize + len(key) + len(data)), nil
+}
+
+func sequenceNumber(index, shard int) string {
+	return fmt.Sprintf("%020d%04d", index, shard)
+}
+
+func parseSequenceNumber(seq string) (index, shard int, ok bool) {
+	if len(seq) != 24 {
+		return 0, 0, false
+	}
+	index, e1 := strconv.Atoi(seq[:20])
+	shard, e2 := strconv.Atoi(seq[20:])
+	return index, shard, e1 == nil && e2 == nil
+}
+
+// shardIteratorString encodes the position of the next record to get.
+func shardIteratorString(streamName string, shard, index int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s/%d/%d", streamName, shard, index)))
+}
+
+func parseShardIterator(it string) (streamName string, shard, index int, ok bool) {
+	decoded, e := base64.RawURLEncoding.DecodeString(it)
+	if e != nil {
+		return "", 0, 0, false
+	}
+	parts := strings.Split(string(decoded), "/")
+	if len(parts) != 3 {
+		return "", 0, 0, false
+	}
+	shard, e1 := strconv.Atoi(parts[1])
+	index, e2 := strconv.Atoi(parts[2])
+	return parts[0], shard, index, e1 == nil && e2 == nil && shard >= 0 && index >= 0
+}
+
+func emulatorError(code, format string, args ...interface{}) error {
+	return &kinesis.Error{StatusCode: 400, Code: code, Message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,148 @@
+package dlog
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/goamz/kinesis"
+	"github.com/stretchr/testify/assert"
+)
+
+// readStream returns elements of clicks in all shards of a stream.
+func readStream(t *testing.T, k *KinesisEmulator, stream string) []string {
+	assert := assert.New(t)
+
+	desc, e := k.DescribeStream(stream)
+	assert.Nil(e)
+
+	r := NewReader(nil)
+	var elements []string
+	for _, shard := range desc.Shards {
+		it, e := k.GetShardIterator(shard.ShardId, stream, kinesis.ShardIteratorTrimHorizon, "")
+		assert.Nil(e)
+
+		next := it.ShardIterator
+		for {
+			resp, e := k.GetRecords(next, 2)
+			assert.Nil(e)
+			if len(resp.Records) == 0 {
+				break
+			}
+			for _, rec := range resp.Records {
+				assert.Nil(r.Handle("github.com-topicai-dlog.click", rec.Data, func(msg interface{}, env *Envelope) error {
+					elements = append(elements, msg.(*click).Element)
+					return nil
+				}))
+			}
+			next = resp.NextShardIterator
+		}
+	}
+	sort.Strings(elements)
+	return elements
+}
+
+func TestKinesisEmulator(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+
+	k, e := NewKinesisEmulator(dir)
+	assert.Nil(e)
+
+	l, e := NewLogger(&click{}, &Options{
+		SyncPeriod:     10 * time.Millisecond,
+		UseMockKinesis: true,
+		MockKinesis:    k,
+	})
+	assert.Nil(e)
+	RegisterType(click{})
+	assert.Nil(k.CreateStream(l.streamName, 3))
+	assert.NotNil(k.CreateStream(l.streamName, 3))
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		assert.Nil(l.LogSync(context.Background(), click{Element: strconv.Itoa(i)}))
+		want = append(want, strconv.Itoa(i))
+	}
+	assert.Nil(l.Close())
+	assert.Equal(want, readStream(t, k, l.streamName))
+	assert.Nil(k.Close())
+
+	// Records are kept on disk.
+	k, e = NewKinesisEmulator(dir)
+	assert.Nil(e)
+	defer k.Close()
+	assert.Equal(want, readStream(t, k, l.streamName))
+
+	assert.Nil(k.DeleteStream(l.streamName))
+	_, e = k.DescribeStream(l.streamName)
+	assert.NotNil(e)
+}
+
+func TestKinesisEmulatorIterators(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+
+	k, e := NewKinesisEmulator(dir)
+	assert.Nil(e)
+	defer k.Close()
+	assert.Nil(k.CreateStream("s", 2))
+
+	// All keys of one shard, by the explicit hash key.
+	var entries []kinesis.PutRecordsRequestEntry
+	for i := 0; i < 3; i++ {
+		entries = append(entries, kinesis.PutRecordsRequestEntry{Data: []byte{byte(i)}, PartitionKey: "k", ExplicitHashKey: "1"})
+	}
+	resp, e := k.PutRecords("s", entries)
+	assert.Nil(e)
+	assert.Equal("shardId-000000000000", resp.Records[0].ShardId)
+	assert.True(resp.Records[0].SequenceNumber < resp.Records[1].SequenceNumber)
+
+	get := func(typ kinesis.ShardIteratorType, seq string) []kinesis.Record {
+		it, e := k.GetShardIterator("shardId-000000000000", "s", typ, seq)
+		assert.Nil(e)
+		records, e := k.GetRecords(it.ShardIterator, 0)
+		assert.Nil(e)
+		return records.Records
+	}
+	assert.Equal(3, len(get(kinesis.ShardIteratorTrimHorizon, "")))
+	assert.Equal(0, len(get(kinesis.ShardIteratorLatest, "")))
+	assert.Equal([]byte{1}, get(kinesis.ShardIteratorAtSequenceNumber, resp.Records[1].SequenceNumber)[0].Data)
+	assert.Equal([]byte{2}, get(kinesis.ShardIteratorAfterSequenceNumber, resp.Records[1].SequenceNumber)[0].Data)
+
+	_, e = k.GetShardIterator("shardId-000000000001", "s", kinesis.ShardIteratorAtSequenceNumber, resp.Records[1].SequenceNumber)
+	assert.NotNil(e)
+	_, e = k.GetRecords("garbage", 0)
+	assert.NotNil(e)
+	_, e = k.PutRecords("missing", entries)
+	assert.NotNil(e)
+
+	// An invalid record fails the request without writing the others.
+	_, e = k.PutRecords("s", []kinesis.PutRecordsRequestEntry{
+		{Data: []byte{3}, PartitionKey: "k", ExplicitHashKey: "1"},
+		{Data: []byte{4}, PartitionKey: ""},
+	})
+	assert.NotNil(e)
+	assert.Equal(3, len(get(kinesis.ShardIteratorTrimHorizon, "")))
+
+	// Explicit hash keys must be in [0, 2^128).
+	for _, key := range []string{"-1", "340282366920938463463374607431768211456"} {
+		_, e = k.PutRecords("s", []kinesis.PutRecordsRequestEntry{{Data: []byte{5}, PartitionKey: "k", ExplicitHashKey: key}})
+		assert.NotNil(e, key)
+	}
+	_, e = k.PutRecords("s", []kinesis.PutRecordsRequestEntry{
+		{Data: []byte{5}, PartitionKey: "k", ExplicitHashKey: "340282366920938463463374607431768211455"},
+	})
+	assert.Nil(e)
+	assert.Equal(3, len(get(kinesis.ShardIteratorTrimHorizon, "")))
+}
@@ -0,0 +1,97 @@
+package dlog
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+)
+
+// envelopeMagic starts every record written by Logger.  A gob stream
+// never starts with a zero byte, so consumers can tell enveloped
+// records from records of older versions, which are plain
+// gob-encoded messages.
+const envelopeMagic = "\x00dlog1"
+
+var envelopeType = reflect.TypeOf(Envelope{})
+
+// Envelope is the content of Kinesis records written by Logger with
+// Options.Envelope, or with features that need it: the gob-encoded
+// message and its metadata.
+type Envelope struct {
+	// SampleRate is the fraction of messages kept by sampling.  0
+	// means that the Logger doesn't sample.
+	SampleRate float64
+
+	// Transformed maps paths of fields transformed by dlog struct
+	// tags, like "User.Session", to the actions, like "hash".
+	Transformed map[string]string
+
+	// ProducerID identifies the Logger, which numbers its records by
+	// Seq from 1 without gaps.
+	ProducerID string
+	Seq        uint64
+
+	// RecordID is the unique ID of the message, if it is a RecordIDer
+	// or Options.RecordIDs is set.
+	RecordID string
+
+	// Heartbeat is not nil for heartbeat records, which have no
+	// Message.
+	Heartbeat *Heartbeat
+
+	// If KeyID is not empty, Message is encrypted by AES-GCM with
+	// the key of KeyID and Nonce.  Use Reader to decrypt it.
+	KeyID string
+	Nonce []byte
+
+	// If Signature is not empty, it is the HMAC-SHA256 of the other
+	// fields with the key of SigningKeyID.
+	SigningKeyID string
+	Signature    []byte
+
+	// Message is the gob-encoded log message.
+	Message []byte
+}
+
+// Weight returns how many messages this record represents, which is
+// 1/SampleRate, for analysts to re-weight counts of sampled streams.
+func (env *Envelope) Weight() float64 {
+	if env.SampleRate <= 0 {
+		return 1
+	}
+	return 1 / env.SampleRate
+}
+
+// needsEnvelope returns whether a Logger of message type t writes
+// envelopes.  redacted is whether t has dlog tags or interface fields,
+// whose values might have them.
+func needsEnvelope(t reflect.Type, o *Options, sampled, redacted bool) bool {
+	ider := reflect.TypeOf((*RecordIDer)(nil)).Elem()
+	return o.Envelope || sampled || redacted || o.RecordIDs ||
+		t.Implements(ider) || reflect.PtrTo(t).Implements(ider) ||
+		o.HeartbeatPeriod > 0 || o.EncryptionKeys != nil || o.SigningKeys != nil
+}
+
+func sealEnvelope(env *Envelope) ([]byte, error) {
+	buf := bytes.NewBufferString(envelopeMagic)
+	if e := gob.NewEncoder(buf).Encode(env); e != nil {
+		return nil, &EncodeError{Type: envelopeType, Err: e}
+	}
+	return buf.Bytes(), nil
+}
+
+// OpenEnvelope decodes the content of a Kinesis record written by
+// Logger.  Records written by older versions of dlog are returned as
+// an Envelope without metadata.
+func OpenEnvelope(data []byte) (*Envelope, error) {
+	if !bytes.HasPrefix(data, []byte(envelopeMagic)) {
+		return &Envelope{Message: data}, nil
+	}
+
+	env := &Envelope{}
+	if e := gob.NewDecoder(bytes.NewReader(data[len(envelopeMagic):])).Decode(env); e != nil {
+		return nil, fmt.Errorf("Cannot decode dlog envelope: %v", e)
+	}
+	return env, nil
+}
@@ -0,0 +1,74 @@
+package dlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelope(t *testing.T) {
+	assert := assert.New(t)
+
+	en, e := encode(click{Session: "s"})
+	assert.Nil(e)
+
+	data, e := sealEnvelope(&Envelope{SampleRate: 0.25, Message: en})
+	assert.Nil(e)
+
+	env, e := OpenEnvelope(data)
+	assert.Nil(e)
+	assert.Equal(0.25, env.SampleRate)
+	assert.Equal(4.0, env.Weight())
+	assert.Equal(en, env.Message)
+
+	// Plain gob-encoded messages written by older versions.
+	env, e = OpenEnvelope(en)
+	assert.Nil(e)
+	assert.Equal(en, env.Message)
+	assert.Equal(1.0, env.Weight())
+
+	_, e = OpenEnvelope([]byte(envelopeMagic + "garbage"))
+	assert.NotNil(e)
+}
+
+func TestLoggerWritesPlainRecordsByDefault(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, enveloped := range []bool{false, true} {
+		l, e := NewLogger(&click{}, &Options{
+			Envelope:       enveloped,
+			UseMockKinesis: true,
+			MockKinesis:    newKinesisMock(0),
+		})
+		assert.Nil(e)
+		assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+		assert.Nil(l.LogSync(context.Background(), click{Session: "s"}))
+		assert.Nil(l.Close())
+
+		// Consumers of older versions gob-decode records directly.
+		data := l.kinesis.(*kinesisMock).storage[l.streamName][0][0].Data
+		assert.Equal(enveloped, bytes.HasPrefix(data, []byte(envelopeMagic)))
+		if !enveloped {
+			var c click
+			assert.Nil(gob.NewDecoder(bytes.NewReader(data)).Decode(&c))
+			assert.Equal("s", c.Session)
+		}
+
+		env, e := OpenEnvelope(data)
+		assert.Nil(e)
+		assert.Equal(enveloped, env.Seq == 1)
+	}
+
+	// Features that need envelopes imply them.
+	l, e := NewLogger(&click{}, &Options{
+		RecordIDs:      true,
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.True(l.enveloped)
+	assert.Nil(l.Close())
+}
@@ -0,0 +1,84 @@
+package dlog
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Errors returned by NewLogger and Logger.Log.  Callers can match
+// them with errors.Is, and get more details from the typed errors
+// below with errors.As.
+var (
+	ErrWrongType         = errors.New("dlog: wrong message type")
+	ErrMessageTooLarge   = errors.New("dlog: message too large")
+	ErrWriteTimeout      = errors.New("dlog: write timeout")
+	ErrClosed            = errors.New("dlog: logger closed")
+	ErrDropped           = errors.New("dlog: message dropped by overflow policy")
+	ErrInvalidStreamName = errors.New("dlog: invalid stream name")
+	ErrEncode            = errors.New("dlog: cannot encode message")
+	ErrUnknownRegion     = errors.New("dlog: unknown region")
+)
+
+// ErrInvalidSignature is returned by Reader if a record is not signed
+// by a key of ReaderOptions.SigningKeys.
+var ErrInvalidSignature = errors.New("dlog: invalid record signature")
+
+// ErrDuplicate is returned by Reader.Open if the record ID is in
+// ReaderOptions.Dedup.
+var ErrDuplicate = errors.New("dlog: duplicate record")
+
+// ErrHeartbeat is returned by Reader.Decode for heartbeat records,
+// which have no message.
+var ErrHeartbeat = errors.New("dlog: heartbeat record")
+
+// WrongTypeError is returned by Logger.Log if the message is not
+// assignable to the type of the Logger.  It matches ErrWrongType.
+type WrongTypeError struct {
+	Got  reflect.Type
+	Want reflect.Type
+}
+
+func (e *WrongTypeError) Error() string {
+	return fmt.Sprintf("dlog: message of type %v not assignable to %v", e.Got, e.Want)
+}
+
+func (e *WrongTypeError) Is(target error) bool {
+	return target == ErrWrongType
+}
+
+// MessageTooLargeError is returned by Logger.Log if the gob-encoded
+// message plus the partition key is larger than Limit bytes.  It
+// matches ErrMessageTooLarge.
+type MessageTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("dlog: size of gob-encoded message plus partition key (%d bytes) larger than %d bytes",
+		e.Size, e.Limit)
+}
+
+func (e *MessageTooLargeError) Is(target error) bool {
+	return target == ErrMessageTooLarge
+}
+
+// EncodeError is returned by Logger.Log and NewLogger if gob fails to
+// encode a message.  It matches ErrEncode.
+type EncodeError struct {
+	Type reflect.Type
+	Err  error
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("dlog: cannot encode message of type %v: %v", e.Type, e.Err)
+}
+
+func (e *EncodeError) Is(target error) bool {
+	return target == ErrEncode
+}
+
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
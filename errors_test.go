@@ -0,0 +1,52 @@
+package dlog
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	l, e := NewLogger(&impression{}, &Options{
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+
+	e = l.Log(&click{})
+	assert.True(errors.Is(e, ErrWrongType))
+	var wt *WrongTypeError
+	assert.True(errors.As(e, &wt))
+	assert.Equal(l.msgType, wt.Want)
+
+	e = l.Log(impression{Results: []string{strings.Repeat("x", maxMessageSize)}})
+	assert.True(errors.Is(e, ErrMessageTooLarge))
+	var tl *MessageTooLargeError
+	assert.True(errors.As(e, &tl))
+	assert.True(tl.Size > tl.Limit)
+	assert.Equal(maxMessageSize, tl.Limit)
+
+	assert.Nil(l.Close())
+	assert.True(errors.Is(l.Log(impression{}), ErrClosed))
+	assert.True(errors.Is(l.Close(), ErrClosed))
+}
+
+func TestStreamNameErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, e := (&Options{}).streamName(impression{})
+	assert.True(errors.Is(e, ErrInvalidStreamName))
+
+	_, e = (&Options{StreamNamePrefix: strings.Repeat("p", 128)}).streamName(impression{})
+	assert.True(errors.Is(e, ErrInvalidStreamName))
+
+	_, e = fullMsgTypeName(struct{ Name string }{})
+	assert.True(errors.Is(e, ErrInvalidStreamName))
+
+	_, e = NewLogger(&impression{}, &Options{MockKinesis: newKinesisMock(0)})
+	assert.True(errors.Is(e, ErrInvalidStreamName))
+}
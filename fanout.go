@@ -0,0 +1,270 @@
+package dlog
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFanoutBuffer       = 100
+	defaultFanoutRetryBackoff = 100 * time.Millisecond
+)
+
+// FanoutMode decides when FanoutSink considers a record written.
+type FanoutMode int
+
+const (
+	// FanoutAll waits for every child to write the record, or to give
+	// up after its retries.  The record fails only if no child wrote
+	// it, so that retries of Logger don't duplicate it in children
+	// that did.  Children that gave up count failedRecords.
+	FanoutAll FanoutMode = iota
+
+	// FanoutAny requires one child to write the record.  Put returns
+	// once every record is written by a child, without waiting for
+	// slower children.
+	FanoutAny
+
+	// FanoutBestEffort returns once the batch is in the buffers of
+	// children.  Failures of children are only counted in metrics.
+	FanoutBestEffort
+)
+
+// FanoutChild is a Sink of FanoutSink with its own buffer and
+// retries.
+type FanoutChild struct {
+	// Name tells apart metrics of children, which are named
+	// "<Name>--fanout-<index>--<time>", so names may repeat or be
+	// empty.
+	Name string
+	Sink Sink
+
+	// Buffer is the number of batches waiting for Sink.  A batch is
+	// dropped for this child when the buffer is full.  0 means 100.
+	Buffer int
+
+	// Failed records are retried Retries times, waiting for
+	// RetryBackoff, then twice as long for each retry.  0 means 100ms.
+	Retries      int
+	RetryBackoff time.Duration
+}
+
+// FanoutSink writes each batch into several sinks, like Kinesis and a
+// FileSink during migrations.  Each child writes batches from its own
+// buffer in its own goroutine, so one slow child doesn't block the
+// others.
+type FanoutSink struct {
+	mode     FanoutMode
+	children []*fanoutChild
+
+	lock   sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type fanoutChild struct {
+	FanoutChild
+	batches chan *fanoutBatch
+
+	// dlog exposed runtime metrics, keyed by writtenRecords,
+	// failedRecords, retriedRecords and droppedBatches.
+	metrics *expvar.Map
+}
+
+type fanoutBatch struct {
+	stream  string
+	records []SinkRecord
+	result  chan fanoutResult // nil for FanoutBestEffort.
+}
+
+type fanoutResult struct {
+	failed []error
+	e      error
+}
+
+// NewFanoutSink returns a FanoutSink writing every batch into the
+// children in mode.  Each child has its own buffer and goroutine,
+// which Close stops.  It requires at least one child.
+func NewFanoutSink(mode FanoutMode, children ...FanoutChild) (*FanoutSink, error) {
+	if len(children) == 0 {
+		return nil, fmt.Errorf("FanoutSink requires at least one child")
+	}
+
+	createdTime := time.Now().UnixNano()
+	s := &FanoutSink{mode: mode}
+	for i, c := range children {
+		if c.Buffer <= 0 {
+			c.Buffer = defaultFanoutBuffer
+		}
+		if c.RetryBackoff <= 0 {
+			c.RetryBackoff = defaultFanoutRetryBackoff
+		}
+
+		child := &fanoutChild{
+			FanoutChild: c,
+			batches:     make(chan *fanoutBatch, c.Buffer),
+			metrics:     expvar.NewMap(fmt.Sprintf("%v--fanout-%d--%v", c.Name, i, createdTime)),
+		}
+		s.children = append(s.children, child)
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			child.run()
+		}()
+	}
+	return s, nil
+}
+
+func (s *FanoutSink) Put(streamName string, records []SinkRecord) ([]error, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	var result chan fanoutResult
+	if s.mode != FanoutBestEffort {
+		result = make(chan fanoutResult, len(s.children))
+	}
+
+	pending := 0
+	errs := make([][]error, len(records)) // Of each child.
+	for _, c := range s.children {
+		select {
+		case c.batches <- &fanoutBatch{stream: streamName, records: records, result: result}:
+			pending++
+		default:
+			c.metrics.Add("droppedBatches", 1)
+			e := fmt.Errorf("dlog fan-out child %s: buffer full", c.Name)
+			for i := range records {
+				errs[i] = append(errs[i], e)
+			}
+		}
+	}
+
+	if s.mode == FanoutBestEffort {
+		return nil, nil
+	}
+
+	written := make([]bool, len(records))
+	for ; pending > 0; pending-- {
+		r := <-result
+		for i := range records {
+			e := r.e
+			if e == nil && i < len(r.failed) {
+				e = r.failed[i]
+			}
+			if e != nil {
+				errs[i] = append(errs[i], e)
+			} else {
+				written[i] = true
+			}
+		}
+
+		if s.mode == FanoutAny && all(written) {
+			return nil, nil
+		}
+	}
+
+	// Children retry failures themselves, so only records that no
+	// child wrote are failed.
+	var failed []error
+	for i := range records {
+		if !written[i] {
+			if failed == nil {
+				failed = make([]error, len(records))
+			}
+			failed[i] = errs[i][0]
+		}
+	}
+	return failed, nil
+}
+
+// Close waits until children write buffered batches.  It doesn't
+// close the child sinks.
+func (s *FanoutSink) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	for _, c := range s.children {
+		close(c.batches)
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+func (c *fanoutChild) run() {
+	for b := range c.batches {
+		failed, e := c.put(b.stream, b.records)
+		if b.result != nil {
+			b.result <- fanoutResult{failed: failed, e: e}
+		}
+	}
+}
+
+// put writes records into the child sink, and retries failed records.
+func (c *fanoutChild) put(stream string, records []SinkRecord) ([]error, error) {
+	failed, e := c.Sink.Put(stream, records)
+
+	indexes := make([]int, len(records)) // Of records in the original batch.
+	for i := range indexes {
+		indexes[i] = i
+	}
+	result := make([]error, len(records))
+
+	backoff := c.RetryBackoff
+	for retry := 0; ; retry++ {
+		var retryIndexes []int
+		for j, i := range indexes {
+			err := e
+			if err == nil && j < len(failed) {
+				err = failed[j]
+			}
+			result[i] = err
+			if err != nil {
+				retryIndexes = append(retryIndexes, i)
+			}
+		}
+
+		c.metrics.Add("writtenRecords", int64(len(indexes)-len(retryIndexes)))
+		if len(retryIndexes) == 0 || retry >= c.Retries {
+			c.metrics.Add("failedRecords", int64(len(retryIndexes)))
+			break
+		}
+		c.metrics.Add("retriedRecords", int64(len(retryIndexes)))
+
+		time.Sleep(backoff)
+		backoff *= 2
+
+		retryRecords := make([]SinkRecord, 0, len(retryIndexes))
+		for _, i := range retryIndexes {
+			retryRecords = append(retryRecords, records[i])
+		}
+		indexes = retryIndexes
+		failed, e = c.Sink.Put(stream, retryRecords)
+	}
+
+	for _, err := range result {
+		if err != nil {
+			return result, nil
+		}
+	}
+	return nil, nil
+}
+
+func all(bs []bool) bool {
+	for _, b := range bs {
+		if !b {
+			return false
+		}
+	}
+	return true
+}
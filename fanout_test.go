@@ -0,0 +1,143 @@
+package dlog
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// scriptedSink fails the first failures calls, and waits for delay
+// in each call.
+type scriptedSink struct {
+	lock     sync.Mutex
+	delay    time.Duration
+	failures int
+	calls    int
+	written  []string
+}
+
+func (s *scriptedSink) Put(stream string, records []SinkRecord) ([]error, error) {
+	time.Sleep(s.delay)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.calls++
+	if s.calls <= s.failures {
+		return nil, errors.New("unavailable")
+	}
+	for _, r := range records {
+		s.written = append(s.written, string(r.Data))
+	}
+	return nil, nil
+}
+
+func testBatch() []SinkRecord {
+	return []SinkRecord{{Data: []byte("a")}, {Data: []byte("b")}}
+}
+
+func TestFanoutAll(t *testing.T) {
+	assert := assert.New(t)
+
+	good, flaky, broken := &scriptedSink{}, &scriptedSink{failures: 1}, &scriptedSink{failures: 100}
+	s, e := NewFanoutSink(FanoutAll,
+		FanoutChild{Name: "good", Sink: good},
+		FanoutChild{Name: "flaky", Sink: flaky, Retries: 1, RetryBackoff: time.Millisecond})
+	assert.Nil(e)
+
+	failed, e := s.Put("stream", testBatch())
+	assert.Nil(failed)
+	assert.Nil(e)
+	assert.Equal([]string{"a", "b"}, flaky.written)
+	assert.Equal("2", s.children[1].metrics.Get("retriedRecords").String())
+	assert.Nil(s.Close())
+
+	// Records written by good are not failed, so that Logger doesn't
+	// write them into good again.
+	s, e = NewFanoutSink(FanoutAll, FanoutChild{Name: "good", Sink: good}, FanoutChild{Name: "broken", Sink: broken})
+	assert.Nil(e)
+	failed, e = s.Put("stream", testBatch())
+	assert.Nil(failed)
+	assert.Nil(e)
+	assert.Equal([]string{"a", "b", "a", "b"}, good.written)
+	assert.Equal("2", s.children[1].metrics.Get("failedRecords").String())
+	assert.Nil(s.Close())
+
+	_, e = s.Put("stream", testBatch())
+	assert.Equal(ErrClosed, e)
+
+	// Records written by no child fail.
+	s, e = NewFanoutSink(FanoutAll, FanoutChild{Name: "broken", Sink: broken})
+	assert.Nil(e)
+	failed, e = s.Put("stream", testBatch())
+	assert.Nil(e)
+	assert.Equal(2, len(failed))
+	assert.NotNil(failed[0])
+	assert.Nil(s.Close())
+
+	_, e = NewFanoutSink(FanoutAll)
+	assert.NotNil(e)
+}
+
+func TestFanoutAny(t *testing.T) {
+	assert := assert.New(t)
+
+	fast, slow, broken := &scriptedSink{}, &scriptedSink{delay: 300 * time.Millisecond}, &scriptedSink{failures: 100}
+	s, e := NewFanoutSink(FanoutAny,
+		FanoutChild{Name: "fast", Sink: fast},
+		FanoutChild{Name: "slow", Sink: slow},
+		FanoutChild{Name: "broken", Sink: broken})
+	assert.Nil(e)
+
+	start := time.Now()
+	failed, e := s.Put("stream", testBatch())
+	assert.Nil(failed)
+	assert.Nil(e)
+	assert.True(time.Since(start) < 200*time.Millisecond) // Doesn't wait for slow.
+
+	assert.Nil(s.Close())
+	assert.Equal([]string{"a", "b"}, slow.written)
+
+	s, e = NewFanoutSink(FanoutAny, FanoutChild{Name: "broken", Sink: broken})
+	assert.Nil(e)
+	failed, e = s.Put("stream", testBatch())
+	assert.Nil(e)
+	assert.NotNil(failed[1])
+	assert.Nil(s.Close())
+}
+
+func TestFanoutBestEffort(t *testing.T) {
+	assert := assert.New(t)
+
+	slow := &scriptedSink{delay: 100 * time.Millisecond}
+	s, e := NewFanoutSink(FanoutBestEffort, FanoutChild{Name: "slow", Sink: slow, Buffer: 1})
+	assert.Nil(e)
+
+	// The first batch is being written, the second is buffered, and
+	// the third is dropped.
+	for i := 0; i < 3; i++ {
+		failed, e := s.Put("stream", testBatch())
+		assert.Nil(failed)
+		assert.Nil(e)
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(s.Close())
+	assert.Equal(4, len(slow.written))
+	assert.Equal("1", s.children[0].metrics.Get("droppedBatches").String())
+}
+
+func TestFanoutChildrenWithoutNames(t *testing.T) {
+	assert := assert.New(t)
+
+	// Metrics of children of the same or empty names don't collide.
+	a, b := &scriptedSink{}, &scriptedSink{}
+	s, e := NewFanoutSink(FanoutAll, FanoutChild{Sink: a}, FanoutChild{Sink: b},
+		FanoutChild{Name: "x", Sink: a}, FanoutChild{Name: "x", Sink: b})
+	assert.Nil(e)
+	_, e = s.Put("stream", testBatch())
+	assert.Nil(e)
+	assert.Equal("2", s.children[3].metrics.Get("writtenRecords").String())
+	assert.Nil(s.Close())
+}
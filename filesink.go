@@ -0,0 +1,329 @@
+package dlog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFileMaxBytes = 128 * 1024 * 1024
+	defaultFileMaxAge   = time.Hour
+
+	// Files are written into directories of the hour, like Firehose.
+	fileHourLayout = "2006/01/02/15"
+	fileTimeLayout = "2006-01-02-15-04-05"
+
+	fileExt = ".dlog"
+	gzipExt = ".gz"
+	tmpExt  = ".tmp" // Of files being compressed.
+)
+
+// FileSink writes records into local files of frames, which
+// ReadArchive reads.  Files of a stream are named like
+// Dir/YYYY/MM/DD/HH/<stream>-YYYY-MM-DD-HH-MM-SS-<n>.dlog by their
+// creation time in UTC, and rotated once they are larger than
+// MaxBytes, older than MaxAge, or at the end of the hour.  Files of
+// idle streams are rotated by timers, and all files are closed by
+// Close.
+type FileSink struct {
+	Dir string
+
+	// 0 means 128MB and 1 hour.
+	MaxBytes int64
+	MaxAge   time.Duration
+
+	// If Gzip, closed files are compressed into .dlog.gz files in
+	// the background.
+	Gzip bool
+
+	// If Retention > 0, files of streams written by the FileSink that
+	// were modified earlier than Retention ago are removed after each
+	// rotation.
+	Retention time.Duration
+
+	lock    sync.Mutex
+	files   map[string]*sinkFile // Keyed by stream name.
+	streams map[string]bool      // Every stream written.
+	serial  int                  // Tells apart files of the same second.
+	now     func() time.Time
+
+	compressing sync.WaitGroup
+	gzipping    map[string]bool // Paths of files being compressed.
+}
+
+type sinkFile struct {
+	f       *os.File
+	size    int64
+	created time.Time
+	timer   *time.Timer // Rotates the file when it expires.
+}
+
+func (s *FileSink) Put(streamName string, records []SinkRecord) ([]error, error) {
+	var buf []byte
+	for _, r := range records {
+		buf = appendFrame(buf, r.Data)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, e := s.file(streamName)
+	if e != nil {
+		return nil, e
+	}
+
+	if _, e := f.f.WriteAt(buf, f.size); e != nil {
+		// Drop the partially written frames, so that later frames
+		// follow the last good one, or else start a new file.
+		if te := f.f.Truncate(f.size); te != nil {
+			s.rotate(streamName, f)
+		}
+		return nil, e
+	}
+	f.size += int64(len(buf))
+	return nil, nil
+}
+
+// Close closes files of all streams, and waits for their compression.
+func (s *FileSink) Close() error {
+	s.lock.Lock()
+	var err error
+	for stream, f := range s.files {
+		f.timer.Stop()
+		if e := s.closeFile(f); e != nil && err == nil {
+			err = e
+		}
+		delete(s.files, stream)
+	}
+	s.lock.Unlock()
+
+	s.compressing.Wait()
+	return err
+}
+
+// file returns the open file of stream, after rotating it if needed.
+// It requires s.lock.
+func (s *FileSink) file(stream string) (*sinkFile, error) {
+	if s.files == nil {
+		s.files = make(map[string]*sinkFile)
+		s.streams = make(map[string]bool)
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	now := s.now().UTC()
+
+	if f, ok := s.files[stream]; ok {
+		if f.size < s.maxBytes() && s.expiry(f).After(now) {
+			return f, nil
+		}
+		s.rotate(stream, f)
+	}
+
+	dir := filepath.Join(s.Dir, filepath.FromSlash(now.Format(fileHourLayout)))
+	e := os.MkdirAll(dir, 0755)
+	if e != nil {
+		return nil, e
+	}
+
+	// Files of the same second, written by another FileSink or a
+	// previous run, take the next serials.
+	var osf *os.File
+	for {
+		s.serial++
+		name := fmt.Sprintf("%s-%s-%d%s", stream, now.Format(fileTimeLayout), s.serial, fileExt)
+		osf, e = os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(e) {
+			break
+		}
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	f := &sinkFile{f: osf, created: now}
+	f.timer = time.AfterFunc(s.expiry(f).Sub(now), func() { s.expire(stream, f) })
+	s.files[stream] = f
+	s.streams[stream] = true
+	return f, nil
+}
+
+// expiry returns when f is to be rotated by age: after MaxAge, or at
+// the end of the hour of its directory.
+func (s *FileSink) expiry(f *sinkFile) time.Time {
+	expiry := f.created.Add(s.maxAge())
+	if hour := f.created.Truncate(time.Hour).Add(time.Hour); hour.Before(expiry) {
+		return hour
+	}
+	return expiry
+}
+
+// expire rotates f by its timer, if it is still the file of stream.
+func (s *FileSink) expire(stream string, f *sinkFile) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.files[stream] == f {
+		s.rotate(stream, f)
+	}
+}
+
+// rotate closes f, the file of stream, and removes expired files.
+// The next Put of stream opens a new file.  It requires s.lock.
+func (s *FileSink) rotate(stream string, f *sinkFile) {
+	f.timer.Stop()
+	delete(s.files, stream)
+	if e := s.closeFile(f); e != nil {
+		log.Printf("dlog cannot close file %s: %v", f.f.Name(), e)
+	}
+	if s.Retention > 0 {
+		if e := s.removeExpired(s.now().UTC()); e != nil {
+			log.Printf("dlog cannot remove expired files in %s: %v", s.Dir, e)
+		}
+	}
+}
+
+func (s *FileSink) maxBytes() int64 {
+	if s.MaxBytes <= 0 {
+		return defaultFileMaxBytes
+	}
+	return s.MaxBytes
+}
+
+func (s *FileSink) maxAge() time.Duration {
+	if s.MaxAge <= 0 {
+		return defaultFileMaxAge
+	}
+	return s.MaxAge
+}
+
+// closeFile closes f, and compresses it in the background if Gzip.
+// It requires s.lock.
+func (s *FileSink) closeFile(f *sinkFile) error {
+	if e := f.f.Close(); e != nil {
+		return e
+	}
+	if s.Gzip {
+		// removeExpired skips the file until it is compressed.
+		path := f.f.Name()
+		if s.gzipping == nil {
+			s.gzipping = make(map[string]bool)
+		}
+		s.gzipping[path] = true
+
+		s.compressing.Add(1)
+		go func() {
+			defer s.compressing.Done()
+			if e := gzipFile(path); e != nil {
+				log.Printf("dlog cannot compress file %s: %v", path, e)
+			}
+
+			s.lock.Lock()
+			delete(s.gzipping, path)
+			s.lock.Unlock()
+		}()
+	}
+	return nil
+}
+
+// gzipFile compresses path into path.gz, and removes path.  The
+// compressed file is renamed into place once complete, so readers
+// never see a truncated one.
+func gzipFile(path string) error {
+	in, e := os.Open(path)
+	if e != nil {
+		return e
+	}
+	defer in.Close()
+
+	tmp := path + gzipExt + tmpExt
+	out, e := os.Create(tmp)
+	if e != nil {
+		return e
+	}
+	defer os.Remove(tmp) // Fails after the rename.
+
+	w := gzip.NewWriter(out)
+	if _, e := io.Copy(w, in); e != nil {
+		out.Close()
+		return e
+	}
+	if e := w.Close(); e != nil {
+		out.Close()
+		return e
+	}
+	if e := out.Close(); e != nil {
+		return e
+	}
+	if e := os.Rename(tmp, path+gzipExt); e != nil {
+		return e
+	}
+	return os.Remove(path)
+}
+
+// removeExpired removes closed files of streams written by s that
+// were modified before Retention ago, and then empty directories.
+// Files of other streams, and files being compressed with their
+// temporary files, are kept.  Temporary files left by failed
+// compressions are removed like others.  It requires s.lock.
+func (s *FileSink) removeExpired(now time.Time) error {
+	open := make(map[string]bool, len(s.files))
+	for _, f := range s.files {
+		open[f.f.Name()] = true
+	}
+
+	var dirs []string
+	e := filepath.Walk(s.Dir, func(path string, info os.FileInfo, e error) error {
+		if os.IsNotExist(e) {
+			return nil // Renamed by compression.
+		} else if e != nil {
+			return e
+		}
+		if info.IsDir() {
+			if path != s.Dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		name := strings.TrimSuffix(info.Name(), tmpExt)
+		source := strings.TrimSuffix(path, gzipExt+tmpExt)
+		if isArchiveFile(name) && !open[path] && !s.gzipping[source] &&
+			s.written(name) && now.Sub(info.ModTime()) > s.Retention {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+
+	// Remove deeper directories first.  Non-empty ones fail.
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+	return nil
+}
+
+// written returns whether the file name is of a stream written by s.
+// It requires s.lock.
+func (s *FileSink) written(name string) bool {
+	for stream := range s.streams {
+		if _, _, ok := parseArchiveName(name, stream); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isArchiveFile(path string) bool {
+	return strings.HasSuffix(path, fileExt) || strings.HasSuffix(path, fileExt+gzipExt)
+}
@@ -0,0 +1,216 @@
+package dlog
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSinkRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2016, 10, 18, 9, 59, 0, 0, time.UTC)
+	s := &FileSink{Dir: dir, MaxBytes: 20, Gzip: true, now: func() time.Time { return now }}
+
+	put := func(data string) {
+		failed, e := s.Put("stream", []SinkRecord{{Data: []byte(data)}})
+		assert.Nil(failed)
+		assert.Nil(e)
+	}
+	put("0123456789")
+	put("0123456789") // 28 bytes, rotated on the next Put.
+	put("a")
+	now = now.Add(time.Minute) // Next hour.
+	put("b")
+	put("c") // Not rotated.
+	// Other streams don't match.
+	_, e = s.Put("stream--x", []SinkRecord{{Data: []byte("other")}})
+	assert.Nil(e)
+	assert.Nil(s.Close())
+
+	paths, e := filepath.Glob(filepath.Join(dir, "2016/10/18/*/stream-*"))
+	assert.Nil(e)
+	assert.Equal([]string{
+		filepath.Join(dir, "2016/10/18/09/stream-2016-10-18-09-59-00-1.dlog.gz"),
+		filepath.Join(dir, "2016/10/18/09/stream-2016-10-18-09-59-00-2.dlog.gz"),
+		filepath.Join(dir, "2016/10/18/10/stream--x-2016-10-18-10-00-00-4.dlog.gz"),
+		filepath.Join(dir, "2016/10/18/10/stream-2016-10-18-10-00-00-3.dlog.gz"),
+	}, paths)
+
+	var read []string
+	assert.Nil(ReadArchiveDir(dir, "stream", func(data []byte) error {
+		read = append(read, string(data))
+		return nil
+	}))
+	assert.Equal([]string{"0123456789", "0123456789", "a", "b", "c"}, read)
+}
+
+func TestFileSinkRetention(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "2016/01/01/00/stream-2016-01-01-00-00-00-1.dlog")
+	assert.Nil(os.MkdirAll(filepath.Dir(old), 0755))
+	assert.Nil(ioutil.WriteFile(old, nil, 0644))
+	assert.Nil(os.Chtimes(old, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour)))
+
+	s := &FileSink{Dir: dir, MaxBytes: 1, Retention: 24 * time.Hour}
+	for i := 0; i < 2; i++ {
+		_, e := s.Put("stream", []SinkRecord{{Data: []byte("x")}})
+		assert.Nil(e)
+	}
+	assert.Nil(s.Close())
+
+	_, e = os.Stat(old)
+	assert.True(os.IsNotExist(e))
+	_, e = os.Stat(filepath.Join(dir, "2016"))
+	assert.True(os.IsNotExist(e))
+
+	// Files of streams of other sinks are kept.
+	other := filepath.Join(dir, "2016/01/01/00/stream--x-2016-01-01-00-00-00-1.dlog")
+	assert.Nil(os.MkdirAll(filepath.Dir(other), 0755))
+	assert.Nil(ioutil.WriteFile(other, nil, 0644))
+	assert.Nil(os.Chtimes(other, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour)))
+
+	s = &FileSink{Dir: dir, MaxBytes: 1, Retention: 24 * time.Hour}
+	for i := 0; i < 2; i++ {
+		_, e := s.Put("stream", []SinkRecord{{Data: []byte("x")}})
+		assert.Nil(e)
+	}
+	assert.Nil(s.Close())
+	_, e = os.Stat(other)
+	assert.Nil(e)
+}
+
+func TestFileSinkRetentionSkipsCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+
+	hour := filepath.Join(dir, "2016/01/01/00")
+	assert.Nil(os.MkdirAll(hour, 0755))
+	compressing := filepath.Join(hour, "stream-2016-01-01-00-00-00-1.dlog")
+	failed := filepath.Join(hour, "stream-2016-01-01-00-00-00-2.dlog.gz.tmp")
+	for _, path := range []string{compressing, compressing + ".gz.tmp", failed} {
+		assert.Nil(ioutil.WriteFile(path, nil, 0644))
+		assert.Nil(os.Chtimes(path, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour)))
+	}
+
+	// Files being compressed are kept, and temporary files of failed
+	// compressions are removed.
+	s := &FileSink{Dir: dir, Retention: 24 * time.Hour}
+	s.streams = map[string]bool{"stream": true}
+	s.gzipping = map[string]bool{compressing: true}
+	s.lock.Lock()
+	assert.Nil(s.removeExpired(time.Now()))
+	s.lock.Unlock()
+
+	_, e = os.Stat(compressing)
+	assert.Nil(e)
+	_, e = os.Stat(compressing + ".gz.tmp")
+	assert.Nil(e)
+	_, e = os.Stat(failed)
+	assert.True(os.IsNotExist(e))
+
+	delete(s.gzipping, compressing)
+	s.lock.Lock()
+	assert.Nil(s.removeExpired(time.Now()))
+	s.lock.Unlock()
+	_, e = os.Stat(compressing)
+	assert.True(os.IsNotExist(e))
+}
+
+func TestFileSinkRotatesIdleStreams(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+	s := &FileSink{Dir: dir, MaxAge: 20 * time.Millisecond, Gzip: true}
+	_, e = s.Put("stream", []SinkRecord{{Data: []byte("a")}})
+	assert.Nil(e)
+
+	// The file is closed and compressed without further Puts.
+	time.Sleep(100 * time.Millisecond)
+	s.compressing.Wait()
+	paths, e := filepath.Glob(filepath.Join(dir, "*/*/*/*/stream-*"))
+	assert.Nil(e)
+	assert.Equal(1, len(paths))
+	assert.True(strings.HasSuffix(paths[0], fileExt+gzipExt))
+	assert.Nil(s.Close())
+}
+
+func TestFileSinkWriteFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+	s := &FileSink{Dir: dir}
+	_, e = s.Put("stream", []SinkRecord{{Data: []byte("a")}})
+	assert.Nil(e)
+
+	// The write fails, and so does truncation, so the next Put
+	// starts a new file.
+	s.files["stream"].f.Close()
+	_, e = s.Put("stream", []SinkRecord{{Data: []byte("lost")}})
+	assert.NotNil(e)
+	_, e = s.Put("stream", []SinkRecord{{Data: []byte("b")}})
+	assert.Nil(e)
+	assert.Nil(s.Close())
+
+	var read []string
+	assert.Nil(ReadArchiveDir(dir, "stream", func(data []byte) error {
+		read = append(read, string(data))
+		return nil
+	}))
+	assert.Equal([]string{"a", "b"}, read)
+}
+
+func TestLoggerFileSink(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+
+	s := &FileSink{Dir: dir}
+	l, e := NewLogger(&click{}, &Options{
+		Sink:           s,
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+	RegisterType(click{})
+	for i := 0; i < 3; i++ {
+		assert.Nil(l.LogSync(context.Background(), click{Element: strconv.Itoa(i)}))
+	}
+	assert.Nil(l.Close())
+	assert.Nil(s.Close())
+
+	r := NewReader(nil)
+	var elements []string
+	assert.Nil(ReadArchiveDir(dir, l.streamName, func(data []byte) error {
+		return r.Handle("github.com-topicai-dlog.click", data, func(msg interface{}, env *Envelope) error {
+			elements = append(elements, msg.(*click).Element)
+			return nil
+		})
+	}))
+	assert.Equal([]string{"0", "1", "2"}, elements)
+}
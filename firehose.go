@@ -0,0 +1,270 @@
+package dlog
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+)
+
+const (
+	// Limits of Firehose PutRecordBatch.
+	firehoseBatchRecords = 500
+	firehoseBatchBytes   = 4 * 1024 * 1024
+	firehoseRecordBytes  = 1000 * 1024
+
+	defaultFirehoseRetries = 2
+	firehoseRetryBackoff   = 100 * time.Millisecond
+)
+
+// FirehoseInterface is the subset of the Firehose API used by
+// FirehoseSink.
+type FirehoseInterface interface {
+	PutRecordBatch(deliveryStreamName string, records [][]byte) (*PutRecordBatchResponse, error)
+}
+
+// PutRecordBatchResponse is the response of Firehose PutRecordBatch.
+// RequestResponses has a result for each record in order.
+type PutRecordBatchResponse struct {
+	FailedPutCount   int
+	RequestResponses []PutRecordBatchResult
+}
+
+type PutRecordBatchResult struct {
+	RecordId     string `json:",omitempty"`
+	ErrorCode    string `json:",omitempty"`
+	ErrorMessage string `json:",omitempty"`
+}
+
+// Firehose is a client of the Firehose JSON API.
+type Firehose struct {
+	Auth     aws.Auth
+	Region   aws.Region
+	Endpoint string // Like https://firehose.us-east-1.amazonaws.com.
+	Client   *http.Client
+
+	// If Credentials is not nil, it replaces Auth and is retrieved
+	// before every call.
+	Credentials CredentialsProvider
+}
+
+// NewFirehose returns a client of Firehose in region.  If endpoint is
+// empty, it is the public endpoint of the region, and unknown region
+// names fail with ErrUnknownRegion.  Otherwise region.Name defaults to
+// us-east-1 for signing requests, as in Options.Endpoint.
+func NewFirehose(auth aws.Auth, region aws.Region, endpoint string) (*Firehose, error) {
+	resolved, e := resolveRegion(region.Name, endpoint)
+	if e != nil {
+		return nil, e
+	}
+	region.Name = resolved.Name
+
+	if len(endpoint) <= 0 {
+		endpoint = serviceEndpoint("firehose", region.Name)
+	}
+	return &Firehose{Auth: auth, Region: region, Endpoint: endpoint, Client: http.DefaultClient}, nil
+}
+
+type putRecordBatchRequest struct {
+	DeliveryStreamName string
+	Records            []firehoseRecord
+}
+
+type firehoseRecord struct {
+	Data []byte // Encoded in base64 by encoding/json.
+}
+
+func (f *Firehose) PutRecordBatch(deliveryStreamName string, records [][]byte) (*PutRecordBatchResponse, error) {
+	req := putRecordBatchRequest{DeliveryStreamName: deliveryStreamName}
+	for _, r := range records {
+		req.Records = append(req.Records, firehoseRecord{Data: r})
+	}
+
+	resp := &PutRecordBatchResponse{}
+	if e := f.call("PutRecordBatch", req, resp); e != nil {
+		return nil, e
+	}
+	return resp, nil
+}
+
+// firehoseError is the body of an error response.
+type firehoseError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (f *Firehose) call(action string, req, resp interface{}) error {
+	body, e := json.Marshal(req)
+	if e != nil {
+		return e
+	}
+
+	hreq, e := http.NewRequest("POST", f.Endpoint+"/", bytes.NewReader(body))
+	if e != nil {
+		return e
+	}
+	hreq.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	hreq.Header.Set("X-Amz-Target", "Firehose_20150804."+action)
+	hreq.Header.Set("X-Amz-Date", time.Now().UTC().Format("20060102T150405Z"))
+	auth := f.Auth
+	if f.Credentials != nil {
+		creds, e := f.Credentials.Retrieve()
+		if e != nil {
+			return e
+		}
+		auth = creds.auth()
+	}
+	aws.NewV4Signer(auth, "firehose", f.Region).Sign(hreq)
+
+	hresp, e := f.Client.Do(hreq)
+	if e != nil {
+		return e
+	}
+	defer hresp.Body.Close()
+
+	content, e := ioutil.ReadAll(hresp.Body)
+	if e != nil {
+		return e
+	}
+
+	if hresp.StatusCode != http.StatusOK {
+		var fe firehoseError
+		json.Unmarshal(content, &fe)
+		return fmt.Errorf("Firehose %s failed with status %d: %s: %s", action, hresp.StatusCode, fe.Type, fe.Message)
+	}
+	return json.Unmarshal(content, resp)
+}
+
+// Separator decides how FirehoseSink separates records, which
+// Firehose concatenates into S3 objects.
+type Separator int
+
+const (
+	// NoSeparator writes records as they are.
+	NoSeparator Separator = iota
+
+	// NewlineSeparator writes each record in base64, followed by a
+	// newline, so that binary records are lines.
+	NewlineSeparator
+
+	// FrameSeparator writes each record in a frame, so that
+	// ReadArchive reads the S3 objects.
+	FrameSeparator
+)
+
+// FirehoseSink writes batches into the Firehose delivery stream of
+// the stream name by PutRecordBatch, in calls of at most 500 records
+// and 4MiB.  Records larger than 1000KiB fail.  Failed records are
+// retried up to Retries times.
+type FirehoseSink struct {
+	Firehose  FirehoseInterface
+	Separator Separator
+
+	// 0 means 2.  Negative means no retries.
+	Retries int
+}
+
+func (s *FirehoseSink) Put(streamName string, records []SinkRecord) ([]error, error) {
+	data := make([][]byte, len(records))
+	failed := make([]error, len(records))
+	pending := make([]int, 0, len(records)) // Indexes of records to put.
+	for i, r := range records {
+		data[i] = s.separate(r.Data)
+		if len(data[i]) > firehoseRecordBytes {
+			failed[i] = &MessageTooLargeError{Size: len(data[i]), Limit: firehoseRecordBytes}
+		} else {
+			pending = append(pending, i)
+		}
+	}
+
+	for retry := 0; len(pending) > 0; retry++ {
+		if retry > 0 {
+			time.Sleep(firehoseRetryBackoff << uint(retry-1))
+		}
+
+		var next []int
+		for len(pending) > 0 {
+			n := batchOf(data, pending)
+			next = append(next, s.putBatch(streamName, data, pending[:n], failed)...)
+			pending = pending[n:]
+		}
+
+		if retry >= s.retries() {
+			break
+		}
+		pending = next
+	}
+
+	for _, e := range failed {
+		if e != nil {
+			return failed, nil
+		}
+	}
+	return nil, nil
+}
+
+// batchOf returns how many of the pending records fit into a call.
+func batchOf(data [][]byte, pending []int) int {
+	n, size := 0, 0
+	for ; n < len(pending) && n < firehoseBatchRecords; n++ {
+		size += len(data[pending[n]])
+		if size > firehoseBatchBytes && n > 0 {
+			break
+		}
+	}
+	return n
+}
+
+// putBatch puts records of indexes, sets their errors in failed, and
+// returns the indexes of failed records.
+func (s *FirehoseSink) putBatch(streamName string, data [][]byte, indexes []int, failed []error) []int {
+	batch := make([][]byte, 0, len(indexes))
+	for _, i := range indexes {
+		batch = append(batch, data[i])
+	}
+
+	resp, e := s.Firehose.PutRecordBatch(streamName, batch)
+	if e != nil {
+		for _, i := range indexes {
+			failed[i] = fmt.Errorf("PutRecordBatch failed: %w", e)
+		}
+		return indexes
+	}
+
+	var retry []int
+	for j, i := range indexes {
+		if j < len(resp.RequestResponses) && len(resp.RequestResponses[j].ErrorCode) > 0 {
+			failed[i] = fmt.Errorf("PutRecordBatch failed: %s: %s",
+				resp.RequestResponses[j].ErrorCode, resp.RequestResponses[j].ErrorMessage)
+			retry = append(retry, i)
+		} else {
+			failed[i] = nil
+		}
+	}
+	return retry
+}
+
+func (s *FirehoseSink) separate(data []byte) []byte {
+	switch s.Separator {
+	case NewlineSeparator:
+		buf := make([]byte, base64.StdEncoding.EncodedLen(len(data))+1)
+		base64.StdEncoding.Encode(buf, data)
+		buf[len(buf)-1] = '\n'
+		return buf
+	case FrameSeparator:
+		return appendFrame(nil, data)
+	}
+	return data
+}
+
+func (s *FirehoseSink) retries() int {
+	if s.Retries == 0 {
+		return defaultFirehoseRetries
+	}
+	return s.Retries
+}
@@ -0,0 +1,171 @@
+package dlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+// firehoseFake is a local fake of Firehose, which fails the first
+// attempt of records containing "flaky".
+type firehoseFake struct {
+	lock    sync.Mutex
+	calls   [][][]byte
+	objects map[string][]byte // Concatenated records of each stream.
+	flaky   map[string]bool
+}
+
+func newFirehoseFake() *firehoseFake {
+	return &firehoseFake{objects: make(map[string][]byte), flaky: make(map[string]bool)}
+}
+
+func (f *firehoseFake) PutRecordBatch(stream string, records [][]byte) (*PutRecordBatchResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if len(records) > firehoseBatchRecords {
+		return nil, errors.New("too many records")
+	}
+	size := 0
+	for _, r := range records {
+		size += len(r)
+	}
+	if size > firehoseBatchBytes {
+		return nil, errors.New("batch too large")
+	}
+
+	f.calls = append(f.calls, records)
+	resp := &PutRecordBatchResponse{}
+	for _, r := range records {
+		if bytes.Contains(r, []byte("flaky")) && !f.flaky[string(r)] {
+			f.flaky[string(r)] = true
+			resp.FailedPutCount++
+			resp.RequestResponses = append(resp.RequestResponses,
+				PutRecordBatchResult{ErrorCode: "ServiceUnavailableException", ErrorMessage: "slow down"})
+			continue
+		}
+		f.objects[stream] = append(f.objects[stream], r...)
+		resp.RequestResponses = append(resp.RequestResponses, PutRecordBatchResult{RecordId: "id"})
+	}
+	return resp, nil
+}
+
+func TestFirehoseSinkLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFirehoseFake()
+	s := &FirehoseSink{Firehose: f}
+
+	var records []SinkRecord
+	for i := 0; i < 1200; i++ {
+		records = append(records, SinkRecord{Data: []byte("r")})
+	}
+	for i := 0; i < 5; i++ {
+		records = append(records, SinkRecord{Data: make([]byte, 1000*1024)})
+	}
+	records = append(records, SinkRecord{Data: make([]byte, 1000*1024+1)})
+
+	failed, e := s.Put("stream", records)
+	assert.Nil(e)
+	assert.Equal(len(records), len(failed))
+	for i, e := range failed[:len(failed)-1] {
+		assert.Nil(e, "record %d", i)
+	}
+	assert.True(errors.Is(failed[len(failed)-1], ErrMessageTooLarge))
+
+	// 500, 500, then 200 small records with 4 large ones, and 1.
+	assert.Equal(4, len(f.calls))
+	assert.Equal(500, len(f.calls[0]))
+	assert.Equal(204, len(f.calls[2]))
+	assert.Equal(1, len(f.calls[3]))
+}
+
+func TestFirehoseSinkRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFirehoseFake()
+	s := &FirehoseSink{Firehose: f, Separator: FrameSeparator}
+	failed, e := s.Put("stream", []SinkRecord{{Data: []byte("a")}, {Data: []byte("flaky")}, {Data: []byte("b")}})
+	assert.Nil(failed)
+	assert.Nil(e)
+	assert.Equal(2, len(f.calls))
+
+	var read []string
+	r := bytes.NewReader(f.objects["stream"])
+	for {
+		data, e := readFrame(r)
+		if e != nil {
+			break
+		}
+		read = append(read, string(data))
+	}
+	assert.Equal([]string{"a", "b", "flaky"}, read)
+
+	// No retries.
+	f = newFirehoseFake()
+	s = &FirehoseSink{Firehose: f, Retries: -1}
+	failed, e = s.Put("stream", []SinkRecord{{Data: []byte("a")}, {Data: []byte("flaky")}})
+	assert.Nil(e)
+	assert.Nil(failed[0])
+	assert.NotNil(failed[1])
+	assert.Equal("a", string(f.objects["stream"]))
+
+	f = newFirehoseFake()
+	s = &FirehoseSink{Firehose: f, Separator: NewlineSeparator}
+	_, e = s.Put("stream", []SinkRecord{{Data: []byte("a")}, {Data: []byte{0, '\n'}}})
+	assert.Nil(e)
+	assert.Equal("YQ==\nAAo=\n", string(f.objects["stream"]))
+}
+
+func TestFirehoseClient(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFirehoseFake()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("Firehose_20150804.PutRecordBatch", r.Header.Get("X-Amz-Target"))
+		assert.True(strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256"))
+
+		var req putRecordBatchRequest
+		assert.Nil(json.NewDecoder(r.Body).Decode(&req))
+		if req.DeliveryStreamName == "missing" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type": "ResourceNotFoundException", "message": "not found"}`))
+			return
+		}
+
+		var records [][]byte
+		for _, r := range req.Records {
+			records = append(records, r.Data)
+		}
+		resp, _ := fake.PutRecordBatch(req.DeliveryStreamName, records)
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	c, e := NewFirehose(aws.Auth{AccessKey: "a", SecretKey: "s"}, aws.Region{Name: "us-east-1"}, server.URL)
+	assert.Nil(e)
+	resp, e := c.PutRecordBatch("stream", [][]byte{[]byte("a"), []byte("flaky")})
+	assert.Nil(e)
+	assert.Equal(1, resp.FailedPutCount)
+	assert.Equal("ServiceUnavailableException", resp.RequestResponses[1].ErrorCode)
+	assert.Equal("a", string(fake.objects["stream"]))
+
+	_, e = c.PutRecordBatch("missing", [][]byte{[]byte("a")})
+	assert.NotNil(e)
+	assert.Contains(e.Error(), "ResourceNotFoundException")
+
+	c, e = NewFirehose(aws.Auth{}, aws.Region{Name: "cn-north-1"}, "")
+	assert.Nil(e)
+	assert.Equal("https://firehose.cn-north-1.amazonaws.com.cn", c.Endpoint)
+
+	_, e = NewFirehose(aws.Auth{}, aws.Region{}, "")
+	assert.True(errors.Is(e, ErrUnknownRegion))
+}
@@ -0,0 +1,130 @@
+package dlog
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Heartbeat is written by Logger every Options.HeartbeatPeriod, so
+// that consumers notice when a producer dies or a stream is
+// misconfigured.
+type Heartbeat struct {
+	// Time is when the Logger wrote the heartbeat.
+	Time time.Time
+
+	// Counters are the metrics of the Logger, like "writtenRecords".
+	Counters map[string]int64
+}
+
+// signed returns the content of h to sign.
+func (h *Heartbeat) signed() []byte {
+	if h == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(h.Counters))
+	for name := range h.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := appendFrame(nil, []byte(h.Time.UTC().Format(time.RFC3339Nano)))
+	for _, name := range names {
+		buf = appendFrame(buf, []byte(fmt.Sprintf("%s=%d", name, h.Counters[name])))
+	}
+	return buf
+}
+
+// heartbeat pushes a heartbeat record into the queue, unless the
+// queue is full.  The partition key is the producer ID, so all
+// heartbeats of a Logger go to the same shard.  Heartbeats have no
+// sequence number, so skipped heartbeats don't look like lost
+// records, and they are not counted as written records.
+func (l *Logger) heartbeat() {
+	env := &Envelope{
+		ProducerID: l.producerID,
+		Heartbeat:  &Heartbeat{Time: time.Now(), Counters: l.counters()},
+	}
+
+	data, e := l.seal(env)
+	if e != nil {
+		log.Printf("dlog cannot seal heartbeat: %v", e)
+		return
+	}
+
+	r := &record{data: data, key: partitionKey(nil, []byte(l.producerID)), enqueued: time.Now(), heartbeat: true}
+	if wait, e := l.queue.push(r); wait != nil || e != nil {
+		log.Printf("dlog skips heartbeat of %s: queue full or closed", l.producerID)
+	}
+}
+
+func (l *Logger) counters() map[string]int64 {
+	dropped := int64(0)
+	l.droppedRecords.Do(func(kv expvar.KeyValue) {
+		dropped += kv.Value.(*expvar.Int).Value()
+	})
+
+	return map[string]int64{
+		"seq":            int64(atomic.LoadUint64(&l.seq)),
+		"writtenRecords": l.writtenRecords.Value(),
+		"failedRecords":  l.failedRecords.Value(),
+		"droppedRecords": dropped,
+		"sampledOut":     l.sampledOut.Value(),
+	}
+}
+
+// ProducerFreshness tells when a Reader last heard from a producer.
+type ProducerFreshness struct {
+	ProducerID string
+
+	// LastHeard is when the Reader read the last heartbeat.
+	LastHeard time.Time
+
+	// Latency is from writing to reading the last heartbeat, which
+	// includes the clock skew between the producer and the Reader.
+	Latency time.Duration
+
+	// Counters of the last heartbeat.
+	Counters map[string]int64
+}
+
+// heartbeatTracker tracks the last heartbeat of every producer.
+type heartbeatTracker struct {
+	lock      sync.Mutex
+	producers map[string]*ProducerFreshness
+}
+
+func newHeartbeatTracker() *heartbeatTracker {
+	return &heartbeatTracker{producers: make(map[string]*ProducerFreshness)}
+}
+
+func (t *heartbeatTracker) observe(env *Envelope, now time.Time) ProducerFreshness {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	f := ProducerFreshness{
+		ProducerID: env.ProducerID,
+		LastHeard:  now,
+		Latency:    now.Sub(env.Heartbeat.Time),
+		Counters:   env.Heartbeat.Counters,
+	}
+	t.producers[env.ProducerID] = &f
+	return f
+}
+
+func (t *heartbeatTracker) report() []ProducerFreshness {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	report := make([]ProducerFreshness, 0, len(t.producers))
+	for _, f := range t.producers {
+		report = append(report, *f)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].ProducerID < report[j].ProducerID })
+	return report
+}
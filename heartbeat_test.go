@@ -0,0 +1,98 @@
+package dlog
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeat(t *testing.T) {
+	assert := assert.New(t)
+
+	l, e := NewLogger(&click{}, &Options{
+		SyncPeriod:      10 * time.Millisecond,
+		HeartbeatPeriod: 50 * time.Millisecond,
+		UseMockKinesis:  true,
+		MockKinesis:     newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+	RegisterType(click{})
+
+	assert.Nil(l.LogSync(context.Background(), click{Session: "s"}))
+	time.Sleep(180 * time.Millisecond)
+	assert.Nil(l.Close())
+
+	r := NewReader(nil)
+	typeName := "github.com-topicai-dlog.click"
+	handled, heartbeats := 0, 0
+	for _, b := range l.kinesis.(*kinesisMock).storage[l.streamName] {
+		for _, entry := range b {
+			assert.Nil(r.Handle(typeName, entry.Data, func(msg interface{}, env *Envelope) error {
+				assert.Equal("s", msg.(*click).Session)
+				handled++
+				return nil
+			}))
+
+			if _, e := plainReader.Decode(typeName, entry.Data); errors.Is(e, ErrHeartbeat) {
+				heartbeats++
+			}
+		}
+	}
+	assert.Equal(1, handled)
+	assert.True(heartbeats >= 2)
+
+	freshness := r.Freshness()
+	assert.Equal(1, len(freshness))
+	assert.Equal(l.ProducerID(), freshness[0].ProducerID)
+	assert.True(freshness[0].Latency >= 0)
+	assert.Equal(int64(1), freshness[0].Counters["writtenRecords"]) // Without heartbeats.
+	assert.Equal(int64(1), l.writtenRecords.Value())
+	assert.NotNil(r.lastHeard.Get(l.ProducerID()))
+
+	// Heartbeats don't take sequence numbers of messages.
+	loss := r.LossReport()
+	assert.Equal(uint64(1), loss[0].LastSeq)
+	assert.Equal(int64(0), loss[0].Missing)
+}
+
+func TestHeartbeatsTakeNoSequenceNumbers(t *testing.T) {
+	assert := assert.New(t)
+
+	l, e := NewLogger(&click{}, &Options{
+		Envelope:       true,
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+
+	// Heartbeats skipped when the queue is full don't leave gaps,
+	// as heartbeats have no sequence numbers.
+	assert.Nil(l.LogSync(context.Background(), click{Session: "a"}))
+	l.heartbeat()
+	assert.Nil(l.LogSync(context.Background(), click{Session: "b"}))
+	assert.Nil(l.Close())
+
+	r := NewReader(nil)
+	heartbeats := 0
+	for _, b := range l.kinesis.(*kinesisMock).storage[l.streamName] {
+		for _, entry := range b {
+			env, e := r.Open(entry.Data)
+			assert.Nil(e)
+			if env.Heartbeat != nil {
+				assert.Equal(uint64(0), env.Seq)
+				heartbeats++
+			}
+		}
+	}
+	assert.Equal(1, heartbeats)
+
+	loss := r.LossReport()
+	assert.Equal(uint64(2), loss[0].LastSeq)
+	assert.Equal(int64(2), loss[0].Received)
+	assert.Equal(int64(0), loss[0].Missing)
+}
@@ -0,0 +1,176 @@
+package dlog
+
+import (
+	"fmt"
+	"time"
+)
+
+// Default backoff before the first retry of KafkaSink.
+const defaultKafkaRetryBackoff = 100 * time.Millisecond
+
+// KafkaAcks is the number of acknowledgements Kafka brokers send
+// before a produce request succeeds.
+type KafkaAcks int
+
+const (
+	// KafkaAcksAll waits for all in-sync replicas.  It is the default,
+	// and required by idempotent producers.
+	KafkaAcksAll KafkaAcks = iota
+	KafkaAcksLeader
+	KafkaAcksNone
+)
+
+// KafkaSettings are the delivery settings of a Kafka producer.
+type KafkaSettings struct {
+	RequiredAcks KafkaAcks
+	Idempotent   bool
+}
+
+// KafkaMessage is a message produced into a partition of a topic.
+type KafkaMessage struct {
+	Topic     string
+	Partition int32
+	Key       []byte
+	Value     []byte
+}
+
+// KafkaProducer is the subset of a Kafka client used by KafkaSink.
+// Acknowledgements and idempotence are settings of the client, which
+// numbers and retries produce requests itself, like
+// Producer.RequiredAcks and Producer.Idempotent of sarama, or
+// RequiredAcks of franz-go, which is idempotent by default.  For
+// example, an adapter of sarama.SyncProducer with the manual
+// partitioner sends messages by SendMessages, and an adapter of a
+// franz-go client by ProduceSync.
+type KafkaProducer interface {
+	// Partitions returns the number of partitions of topic.
+	Partitions(topic string) (int32, error)
+
+	// Settings returns the settings the client was configured with,
+	// which KafkaSink checks against its own.
+	Settings() KafkaSettings
+
+	// Produce writes messages, and returns an error if the whole
+	// request failed, or the error of each message, like Sink.Put.
+	Produce(messages []KafkaMessage) ([]error, error)
+}
+
+// KafkaSink writes records into Kafka.  The topic is the stream name,
+// unless Topic is set, and the Kafka key is the partition key.  The
+// partition is chosen by the MD5 of the key, like Kinesis chooses
+// shards, so a topic with as many partitions as shards of a stream
+// gets the same keys in the partition of the same index.
+type KafkaSink struct {
+	Producer KafkaProducer
+	Topic    func(streamName string) string
+
+	// RequiredAcks and Idempotent must match Producer.Settings, so
+	// that a misconfigured client fails Put rather than silently
+	// weakening delivery.  Idempotent requires KafkaAcksAll.
+	RequiredAcks KafkaAcks
+	Idempotent   bool
+
+	// Messages failed by the producer are retried Retries times,
+	// after RetryBackoff, then twice as long for each retry.  0 means
+	// 100ms.  These retries are new produce requests, which might
+	// write duplicates, so they conflict with Idempotent, whose client
+	// retries without duplicates.
+	Retries      int
+	RetryBackoff time.Duration
+}
+
+// check returns an error if the settings of s conflict, or differ
+// from those of the producer.
+func (s *KafkaSink) check() error {
+	if s.Idempotent && s.RequiredAcks != KafkaAcksAll {
+		return fmt.Errorf("Idempotent KafkaSink requires KafkaAcksAll, got %d", s.RequiredAcks)
+	}
+	if s.Idempotent && s.Retries > 0 {
+		return fmt.Errorf("Idempotent KafkaSink retries in its producer, but has %d Retries", s.Retries)
+	}
+	want := KafkaSettings{RequiredAcks: s.RequiredAcks, Idempotent: s.Idempotent}
+	if got := s.Producer.Settings(); got != want {
+		return fmt.Errorf("Kafka producer settings %+v differ from KafkaSink settings %+v", got, want)
+	}
+	return nil
+}
+
+func (s *KafkaSink) Put(streamName string, records []SinkRecord) ([]error, error) {
+	if e := s.check(); e != nil {
+		return nil, e
+	}
+
+	topic := streamName
+	if s.Topic != nil {
+		topic = s.Topic(streamName)
+	}
+
+	partitions, e := s.Producer.Partitions(topic)
+	if e != nil {
+		return nil, e
+	}
+	if partitions <= 0 {
+		return nil, fmt.Errorf("Kafka topic %s has no partitions", topic)
+	}
+
+	messages := make([]KafkaMessage, 0, len(records))
+	for _, r := range records {
+		messages = append(messages, KafkaMessage{
+			Topic:     topic,
+			Partition: evenShard(partitionKeyHash(r.PartitionKey), partitions),
+			Key:       []byte(r.PartitionKey),
+			Value:     r.Data,
+		})
+	}
+
+	failed := s.produce(messages)
+	for _, e := range failed {
+		if e != nil {
+			return failed, nil
+		}
+	}
+	return nil, nil
+}
+
+// produce writes messages and retries failed ones.  It returns the
+// error of each message.
+func (s *KafkaSink) produce(messages []KafkaMessage) []error {
+	result := make([]error, len(messages))
+	indexes := make([]int, len(messages))
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	backoff := s.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultKafkaRetryBackoff
+	}
+
+	batch := messages
+	for retry := 0; ; retry++ {
+		failed, e := s.Producer.Produce(batch)
+
+		var retryIndexes []int
+		for j, i := range indexes {
+			err := e
+			if err == nil && j < len(failed) {
+				err = failed[j]
+			}
+			result[i] = err
+			if err != nil {
+				retryIndexes = append(retryIndexes, i)
+			}
+		}
+		if len(retryIndexes) == 0 || retry >= s.Retries {
+			return result
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+
+		indexes, batch = retryIndexes, make([]KafkaMessage, 0, len(retryIndexes))
+		for _, i := range retryIndexes {
+			batch = append(batch, messages[i])
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package dlog
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKafkaBroker is an in-process Kafka broker, with a client of
+// settings, which keeps a log of each partition.
+type fakeKafkaBroker struct {
+	lock       sync.Mutex
+	partitions int32
+	settings   KafkaSettings
+	logs       map[topicPartition][]KafkaMessage
+
+	// If lostAcks > 0, the next produce requests are written, but
+	// their acknowledgements are lost.  Idempotent clients retry them,
+	// and the broker drops the duplicates.  Others fail, unless they
+	// wait for no acknowledgements.
+	lostAcks int
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+func newFakeKafkaBroker(partitions int32, settings KafkaSettings) *fakeKafkaBroker {
+	return &fakeKafkaBroker{
+		partitions: partitions,
+		settings:   settings,
+		logs:       make(map[topicPartition][]KafkaMessage),
+	}
+}
+
+func (b *fakeKafkaBroker) Partitions(topic string) (int32, error) {
+	return b.partitions, nil
+}
+
+func (b *fakeKafkaBroker) Settings() KafkaSettings {
+	return b.settings
+}
+
+func (b *fakeKafkaBroker) Produce(messages []KafkaMessage) ([]error, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, m := range messages {
+		tp := topicPartition{m.Topic, m.Partition}
+		b.logs[tp] = append(b.logs[tp], m)
+	}
+
+	if b.lostAcks > 0 {
+		b.lostAcks--
+		if !b.settings.Idempotent && b.settings.RequiredAcks != KafkaAcksNone {
+			return nil, errors.New("RequestTimedOut")
+		}
+	}
+	return nil, nil
+}
+
+func (b *fakeKafkaBroker) count() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	n := 0
+	for _, l := range b.logs {
+		n += len(l)
+	}
+	return n
+}
+
+func kafkaRecords(n int) []SinkRecord {
+	var records []SinkRecord
+	for i := 0; i < n; i++ {
+		records = append(records, SinkRecord{Data: []byte(strconv.Itoa(i)), PartitionKey: "key" + strconv.Itoa(i)})
+	}
+	return records
+}
+
+func TestKafkaSinkPartitions(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newFakeKafkaBroker(4, KafkaSettings{})
+	s := &KafkaSink{
+		Producer: b,
+		Topic:    func(stream string) string { return "dlog." + stream },
+	}
+
+	failed, e := s.Put("stream", kafkaRecords(20))
+	assert.Nil(failed)
+	assert.Nil(e)
+	assert.Equal(20, b.count())
+
+	for tp, l := range b.logs {
+		assert.Equal("dlog.stream", tp.topic)
+		for _, m := range l {
+			assert.Equal(tp.partition, evenShard(partitionKeyHash(string(m.Key)), 4))
+		}
+	}
+
+	b.partitions = 0
+	_, e = s.Put("stream", kafkaRecords(1))
+	assert.NotNil(e)
+}
+
+func TestKafkaSinkIdempotent(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newFakeKafkaBroker(4, KafkaSettings{RequiredAcks: KafkaAcksAll, Idempotent: true})
+	b.lostAcks = 1
+	s := &KafkaSink{Producer: b, RequiredAcks: KafkaAcksAll, Idempotent: true}
+	failed, e := s.Put("stream", kafkaRecords(20))
+	assert.Nil(failed)
+	assert.Nil(e)
+	assert.Equal(20, b.count()) // The client retried without duplicates.
+
+	// Sink retries would write duplicates.
+	s.Retries = 1
+	_, e = s.Put("stream", kafkaRecords(1))
+	assert.NotNil(e)
+	s.Retries = 0
+
+	// Idempotence requires acknowledgements of all replicas.
+	s.RequiredAcks = KafkaAcksLeader
+	_, e = s.Put("stream", kafkaRecords(1))
+	assert.NotNil(e)
+
+	// The client must be configured like the sink.
+	s = &KafkaSink{Producer: newFakeKafkaBroker(4, KafkaSettings{}), Idempotent: true}
+	_, e = s.Put("stream", kafkaRecords(1))
+	assert.NotNil(e)
+	assert.Equal(20, b.count())
+}
+
+func TestKafkaSinkAtLeastOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newFakeKafkaBroker(4, KafkaSettings{RequiredAcks: KafkaAcksLeader})
+	b.lostAcks = 1
+	s := &KafkaSink{Producer: b, RequiredAcks: KafkaAcksLeader, Retries: 1, RetryBackoff: time.Millisecond}
+	failed, e := s.Put("stream", kafkaRecords(20))
+	assert.Nil(failed)
+	assert.Nil(e)
+	assert.Equal(40, b.count()) // Retries of the sink duplicate records.
+
+	b.lostAcks = 1
+	s.Retries = 0
+	failed, e = s.Put("stream", kafkaRecords(2))
+	assert.Nil(e)
+	assert.NotNil(failed[0])
+
+	// Without acknowledgements, lost records are not known.
+	b = newFakeKafkaBroker(4, KafkaSettings{RequiredAcks: KafkaAcksNone})
+	b.lostAcks = 1
+	s = &KafkaSink{Producer: b, RequiredAcks: KafkaAcksNone}
+	failed, e = s.Put("stream", kafkaRecords(2))
+	assert.Nil(failed)
+	assert.Nil(e)
+}
@@ -3,6 +3,7 @@ package dlog
 import (
 	"errors"
 	"fmt"
+	"math/big"
 	"sync"
 	"time"
 
@@ -26,6 +27,9 @@ type kinesisMock struct {
 	// created streams' names
 	streamNames []string
 
+	// number of shards of each stream
+	shardCounts map[string]int
+
 	// lock to solve concurrent call
 	lock sync.RWMutex
 }
@@ -35,10 +39,14 @@ func newKinesisMock(putRecordsLatency time.Duration) *kinesisMock {
 		storage:          make(map[string][][]kinesis.PutRecordsRequestEntry),
 		putRecordLatency: putRecordsLatency,
 		streamNames:      make([]string, 0),
+		shardCounts:      make(map[string]int),
 	}
 }
 
 func (mock *kinesisMock) PutRecords(streamName string, records []kinesis.PutRecordsRequestEntry) (resp *kinesis.PutRecordsResponse, err error) {
+	// Concurrent calls wait in parallel, like with real Kinesis.
+	time.Sleep(mock.putRecordLatency)
+
 	mock.lock.Lock()
 	defer mock.lock.Unlock()
 
@@ -54,8 +62,6 @@ func (mock *kinesisMock) PutRecords(streamName string, records []kinesis.PutReco
 		return nil, errors.New("records length == 0")
 	}
 
-	time.Sleep(mock.putRecordLatency)
-
 	mock.storage[streamName] = append(mock.storage[streamName], records)
 
 	return &kinesis.PutRecordsResponse{
@@ -76,6 +82,7 @@ func (mock *kinesisMock) CreateStream(name string, shardCount int) error {
 	}
 
 	mock.streamNames = append(mock.streamNames, name)
+	mock.shardCounts[name] = shardCount
 	return nil
 }
 
@@ -94,6 +101,7 @@ func (mock *kinesisMock) DescribeStream(name string) (resp *kinesis.StreamDescri
 	resp = &kinesis.StreamDescription{
 		StreamName:   name,
 		StreamStatus: "Active",
+		Shards:       evenShards(mock.shardCounts[name]),
 	}
 	return resp, nil
 }
@@ -119,6 +127,7 @@ func (mock *kinesisMock) DeleteStream(name string) error {
 	}
 
 	mock.streamNames = newStreamNames
+	delete(mock.shardCounts, name)
 	return nil
 }
 
@@ -136,6 +145,30 @@ func (mock *kinesisMock) find(streamName string) bool {
 	return false
 }
 
+// evenShards returns count shards splitting the 128-bit hash key space
+// evenly, as CreateStream of Kinesis does.
+func evenShards(count int) []kinesis.Shard {
+	shards := make([]kinesis.Shard, 0, count)
+	space := new(big.Int).Lsh(big.NewInt(1), 128)
+	for i := 0; i < count; i++ {
+		start := new(big.Int).Div(new(big.Int).Mul(space, big.NewInt(int64(i))), big.NewInt(int64(count)))
+		end := new(big.Int).Div(new(big.Int).Mul(space, big.NewInt(int64(i+1))), big.NewInt(int64(count)))
+		end.Sub(end, big.NewInt(1))
+
+		shards = append(shards, kinesis.Shard{
+			ShardId: fmt.Sprintf("shardId-%012d", i),
+			HashKeyRange: kinesis.HashKeyRange{
+				StartingHashKey: start.String(),
+				EndingHashKey:   end.String(),
+			},
+			SequenceNumberRange: kinesis.SequenceNumberRange{
+				StartingSequenceNumber: "0",
+			},
+		})
+	}
+	return shards
+}
+
 type brokenKinesisMock struct {
 	*kinesisMock
 }
@@ -0,0 +1,163 @@
+package dlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	instanceMetadataEndpoint  = "http://169.254.169.254"
+	containerMetadataEndpoint = "http://169.254.170.2"
+	metadataTimeout           = time.Second
+)
+
+// metadataCredentials is the JSON of credentials of instance and
+// container metadata.
+type metadataCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// InstanceMetadataCredentials gets credentials of the IAM role of the
+// EC2 instance from the instance metadata service, with IMDSv2
+// session tokens.  Endpoint defaults to http://169.254.169.254.
+type InstanceMetadataCredentials struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+func (m *InstanceMetadataCredentials) Retrieve() (*Credentials, error) {
+	endpoint := m.Endpoint
+	if len(endpoint) <= 0 {
+		endpoint = instanceMetadataEndpoint
+	}
+	client := metadataClient(m.Client)
+
+	req, e := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+	if e != nil {
+		return nil, e
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, e := metadataGet(client, req)
+	if e != nil {
+		return nil, fmt.Errorf("%w from instance metadata: %v", ErrNoCredentials, e)
+	}
+
+	path := endpoint + "/latest/meta-data/iam/security-credentials/"
+	get := func(url string) ([]byte, error) {
+		req, e := http.NewRequest("GET", url, nil)
+		if e != nil {
+			return nil, e
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return metadataGet(client, req)
+	}
+
+	roles, e := get(path)
+	if e != nil {
+		return nil, fmt.Errorf("%w from instance metadata: %v", ErrNoCredentials, e)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if len(role) <= 0 {
+		return nil, fmt.Errorf("%w from instance metadata: no IAM role", ErrNoCredentials)
+	}
+
+	content, e := get(path + role)
+	if e != nil {
+		return nil, e
+	}
+	return decodeMetadataCredentials(content)
+}
+
+// ContainerCredentials gets credentials of the ECS task role, or of
+// other container services, from the container metadata endpoint.
+// URI defaults to AWS_CONTAINER_CREDENTIALS_FULL_URI, or to
+// http://169.254.170.2 with AWS_CONTAINER_CREDENTIALS_RELATIVE_URI,
+// and AuthToken to AWS_CONTAINER_AUTHORIZATION_TOKEN.
+type ContainerCredentials struct {
+	URI       string
+	AuthToken string
+	Client    *http.Client
+}
+
+func (c *ContainerCredentials) Retrieve() (*Credentials, error) {
+	uri := c.URI
+	if len(uri) <= 0 {
+		uri = os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	}
+	if len(uri) <= 0 {
+		if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); len(rel) > 0 {
+			uri = containerMetadataEndpoint + rel
+		}
+	}
+	if len(uri) <= 0 {
+		return nil, fmt.Errorf("%w from container metadata: no URI", ErrNoCredentials)
+	}
+
+	token := c.AuthToken
+	if len(token) <= 0 {
+		token = os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	}
+
+	req, e := http.NewRequest("GET", uri, nil)
+	if e != nil {
+		return nil, e
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", token)
+	}
+	content, e := metadataGet(metadataClient(c.Client), req)
+	if e != nil {
+		return nil, fmt.Errorf("%w from container metadata: %v", ErrNoCredentials, e)
+	}
+	return decodeMetadataCredentials(content)
+}
+
+// metadataClient returns client, or a client with a short timeout, as
+// metadata endpoints don't answer outside of AWS.
+func metadataClient(client *http.Client) *http.Client {
+	if client != nil {
+		return client
+	}
+	return &http.Client{Timeout: metadataTimeout}
+}
+
+func metadataGet(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, e := client.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+
+	content, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return nil, e
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s failed with status %d", req.Method, req.URL.Path, resp.StatusCode)
+	}
+	return content, nil
+}
+
+func decodeMetadataCredentials(content []byte) (*Credentials, error) {
+	var m metadataCredentials
+	if e := json.Unmarshal(content, &m); e != nil {
+		return nil, fmt.Errorf("Cannot decode metadata credentials: %v", e)
+	}
+	if len(m.AccessKeyId) <= 0 || len(m.SecretAccessKey) <= 0 {
+		return nil, fmt.Errorf("%w in metadata response", ErrNoCredentials)
+	}
+	return &Credentials{
+		AccessKey:    m.AccessKeyId,
+		SecretKey:    m.SecretAccessKey,
+		SessionToken: m.Token,
+		Expiration:   m.Expiration,
+	}, nil
+}
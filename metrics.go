@@ -0,0 +1,43 @@
+package dlog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// latency is an expvar.Var exposing the count, mean and maximum of
+// observed durations in milliseconds.
+type latency struct {
+	lock  sync.Mutex
+	count int64
+	sum   time.Duration
+	max   time.Duration
+}
+
+func (l *latency) observe(d time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.count++
+	l.sum += d
+	if d > l.max {
+		l.max = d
+	}
+}
+
+func (l *latency) String() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	mean := time.Duration(0)
+	if l.count > 0 {
+		mean = l.sum / time.Duration(l.count)
+	}
+	return fmt.Sprintf(`{"count": %d, "mean_ms": %.3f, "max_ms": %.3f}`,
+		l.count, milliseconds(mean), milliseconds(l.max))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -4,16 +4,29 @@ import (
 	"fmt"
 	"strings"
 	"time"
-
-	"github.com/AdRoll/goamz/aws"
-	"github.com/AdRoll/goamz/kinesis"
-	"github.com/topicai/candy"
 )
 
 type Options struct {
-	AccessKey string
-	SecretKey string
-	Region    string
+	// Credentials provides the AWS credentials, which are refreshed
+	// before they expire.  If nil, AccessKey and SecretKey are used
+	// if set, or else DefaultCredentials, the chain of environment
+	// variables, shared credentials files, web identity, and
+	// container and instance metadata.
+	Credentials CredentialsProvider
+	AccessKey   string
+	SecretKey   string
+
+	// Region is like "us-east-1".  Endpoints of regions unknown to
+	// goamz are derived from the name, following the partition of
+	// the region, like amazonaws.com.cn of "cn-" regions.  Names of
+	// regions newer than dlog must be registered by RegisterRegion.
+	Region string
+
+	// Endpoint replaces the Kinesis endpoint of Region, like
+	// http://localhost:4567 of kinesalite or http://localhost:4566
+	// of localstack.  Region defaults to us-east-1 if Endpoint is
+	// set.
+	Endpoint string
 
 	// StreamNamePrefix is one of "testing", "staging", or
 	// "production".  When StreamNamePrefix is "testing",
@@ -22,15 +35,117 @@ type Options struct {
 	StreamNamePrefix string
 	StreamNameSuffix string
 
-	// The timeout for Logger.Log to write into a channel, when
-	// the channel is blocked at reading end.  0 means wait
-	// forever.
+	// The timeout for Logger.Log to write into the queue, when
+	// the queue is full.  0 means wait forever.
 	WriteTimeout time.Duration
 
 	// a sync goroutine reads messages from the channels, and send
 	// packed messages to Kinesis periodically. 0 means 1 second.
+	// It is the default of BatchAge.
 	SyncPeriod time.Duration
 
+	// The sync goroutine sends a batch to Kinesis once it has
+	// BatchRecords messages or BatchBytes bytes, or once its first
+	// message has waited for BatchAge.  0 means the limits of
+	// Kinesis, 500 messages and 5MB, and SyncPeriod.
+	BatchRecords int
+	BatchBytes   int
+	BatchAge     time.Duration
+
+	// If AdaptiveLinger is true, the batch age limit starts from
+	// MinBatchAge, and grows up to BatchAge when batches get full
+	// and shrinks back when traffic is quiet.  0 means 10ms.
+	AdaptiveLinger bool
+	MinBatchAge    time.Duration
+
+	// MaxInFlight is the maximum number of PutRecords calls in
+	// progress at the same time.  0 means 1.
+	MaxInFlight int
+
+	// If ShardRateLimit is true, Logger gets the shard map of the
+	// stream from DescribeStream every ShardRefreshPeriod, and
+	// holds back batches that would send more than
+	// ShardBytesPerSecond bytes or ShardRecordsPerSecond messages
+	// to a shard.  0 means 1 minute, and the Kinesis limits of 1MB
+	// and 1000 messages per second.
+	ShardRateLimit        bool
+	ShardRefreshPeriod    time.Duration
+	ShardBytesPerSecond   int
+	ShardRecordsPerSecond int
+
+	// The queue between Logger.Log and the sync goroutine holds at
+	// most QueueLength messages, and QueueBytes bytes of encoded
+	// messages.  0 means 10000 messages and 10MB.
+	QueueLength int
+	QueueBytes  int
+
+	// OverflowPolicy decides what Logger.Log does if the queue is
+	// full.  By default, it blocks for at most WriteTimeout.
+	OverflowPolicy OverflowPolicy
+
+	// SpillDir is the directory of spill files used by the
+	// SpillToDisk policy, and by Critical messages with any policy.
+	SpillDir string
+
+	// If Envelope, every record is an Envelope stamped with the
+	// producer ID and a sequence number, which Reader uses to detect
+	// lost records.  Envelopes are also written if Sampling, dlog
+	// tags, RecordIDs, HeartbeatPeriod, EncryptionKeys or SigningKeys
+	// need them, and for message types with interface fields, whose
+	// values might have dlog tags.  Otherwise records are plain
+	// gob-encoded messages, like those of older versions.
+	Envelope bool
+
+	// Sampling, if not nil, keeps only a fraction of messages.  It
+	// overrides the sampling declared by message types implementing
+	// SampledMessage.
+	Sampling *Sampling
+
+	// If EncryptionKeys is not nil, messages are encrypted with its
+	// current key after encoding.  Use Reader with the same keys to
+	// decrypt them.
+	EncryptionKeys KeyProvider
+
+	// If SigningKeys is not nil, records are signed by HMAC-SHA256
+	// with its current key, after encryption.  Use Reader with
+	// ReaderOptions.SigningKeys to verify them.
+	SigningKeys KeyProvider
+
+	// If HeartbeatPeriod > 0, the sync goroutine writes a heartbeat
+	// record every period, which Reader uses to tell when it last
+	// heard from the Logger.
+	HeartbeatPeriod time.Duration
+
+	// If RecordIDs, messages that are not RecordIDer get random
+	// record IDs, so that Reader with ReaderOptions.Dedup drops
+	// duplicates.
+	RecordIDs bool
+
+	// HashKey is the HMAC key of fields tagged dlog:"hash".
+	HashKey []byte
+
+	// Priority is the default priority of messages.  It is
+	// overridden by message types implementing Prioritizer, and by
+	// WithPriority for each call.
+	Priority Priority
+
+	// Implementations lists the concrete types that may appear
+	// behind interface-typed fields of log messages.  NewLogger
+	// registers them with gob, as RegisterType does.
+	Implementations []interface{}
+
+	// Sink is where Logger writes batches.  nil means Kinesis.
+	// Logger doesn't close Sink, which might be shared by Loggers.
+	Sink Sink
+
+	// Records that the sink fails to write are retried up to Retries
+	// times, after RetryBackoff, then twice as long for each retry.
+	// Records of the same partition key stay in order, as the next
+	// batch of the key waits for the retries.  0 means no retries,
+	// and 100ms.
+	Retries      int
+	RetryBackoff time.Duration
+
 	UseMockKinesis bool // By default this is false, which means using AWS Kinesis.
 	MockKinesis    KinesisInterface
 }
@@ -39,11 +154,13 @@ type Options struct {
 // "prefix--typeName(msg)" if suffix is empty.
 func (o *Options) streamName(msg interface{}) (string, error) {
 	if !o.UseMockKinesis && len(o.StreamNamePrefix) <= 0 {
-		return "", fmt.Errorf("Options.Prefix mustn't be empty")
+		return "", fmt.Errorf("%w: Options.Prefix mustn't be empty", ErrInvalidStreamName)
 	}
 
 	tname, e := fullMsgTypeName(msg)
-	candy.Must(e)
+	if e != nil {
+		return "", e
+	}
 
 	stream := fmt.Sprintf("%s--%s", o.StreamNamePrefix, tname)
 	if len(o.StreamNameSuffix) > 0 {
@@ -52,7 +169,7 @@ func (o *Options) streamName(msg interface{}) (string, error) {
 
 	if len(stream) > 128 {
 		// http://docs.aws.amazon.com/kinesis/latest/APIReference/API_CreateStream.html#API_CreateStream_RequestParameters
-		return "", fmt.Errorf("stream name (%s) longer than 128 characters.", stream)
+		return "", fmt.Errorf("%w: stream name (%s) longer than 128 characters.", ErrInvalidStreamName, stream)
 	}
 
 	// We use the same name for Kinesis/Firehose stream and the
@@ -61,6 +178,13 @@ func (o *Options) streamName(msg interface{}) (string, error) {
 	return strings.ToLower(stream), nil
 }
 
+func (o *Options) sink(k KinesisInterface) Sink {
+	if o.Sink != nil {
+		return o.Sink
+	}
+	return &KinesisSink{Kinesis: k}
+}
+
 func (o *Options) kinesis() (KinesisInterface, error) {
 	if o.UseMockKinesis {
 		if o.MockKinesis == nil {
@@ -70,46 +194,20 @@ func (o *Options) kinesis() (KinesisInterface, error) {
 		return o.MockKinesis, nil
 	}
 
-	return kinesis.New(
-		aws.Auth{
-			AccessKey: o.AccessKey,
-			SecretKey: o.SecretKey},
-		awsRegion(o.Region)), nil
+	region, e := resolveRegion(o.Region, o.Endpoint)
+	if e != nil {
+		return nil, e
+	}
+
+	return newCredentialedKinesis(o.credentials(), region), nil
 }
 
-func awsRegion(regionName string) aws.Region {
-	if n := strings.ToLower(regionName); n == "cn-north-1" {
-		// NOTE: github.com/AdRoll/goamz/aws.Regions doesn't include endpoints of Kinesis.
-		return aws.Region{
-			Name: "cn-north-1",
-			EC2Endpoint: aws.ServiceInfo{
-				Endpoint: "https://ec2.cn-north-1.amazonaws.com.cn",
-				Signer:   aws.V2Signature},
-			S3Endpoint:           "https://s3.cn-north-1.amazonaws.com.cn",
-			S3BucketEndpoint:     "",
-			S3LocationConstraint: true,
-			S3LowercaseBucket:    true,
-			SDBEndpoint:          "",
-			SNSEndpoint:          "https://sns.cn-north-1.amazonaws.com.cn",
-			SQSEndpoint:          "https://sqs.cn-north-1.amazonaws.com.cn",
-			SESEndpoint:          "",
-			IAMEndpoint:          "https://iam.cn-north-1.amazonaws.com.cn",
-			ELBEndpoint:          "https://elasticloadbalancing.cn-north-1.amazonaws.com.cn",
-			KMSEndpoint:          "",
-			DynamoDBEndpoint:     "https://dynamodb.cn-north-1.amazonaws.com.cn",
-			CloudWatchServicepoint: aws.ServiceInfo{
-				Endpoint: "https://monitoring.cn-north-1.amazonaws.com.cn",
-				Signer:   aws.V4Signature},
-			AutoScalingEndpoint: "https://autoscaling.cn-north-1.amazonaws.com.cn",
-			RDSEndpoint: aws.ServiceInfo{
-				Endpoint: "https://rds.cn-north-1.amazonaws.com.cn",
-				Signer:   aws.V4Signature},
-			KinesisEndpoint:        "https://kinesis.cn-north-1.amazonaws.com.cn",
-			STSEndpoint:            "https://sts.cn-north-1.amazonaws.com.cn",
-			CloudFormationEndpoint: "",
-			ElastiCacheEndpoint:    "",
-		}
-	} else {
-		return aws.Regions[n]
+func (o *Options) credentials() CredentialsProvider {
+	switch {
+	case o.Credentials != nil:
+		return &CachedCredentials{Provider: o.Credentials}
+	case len(o.AccessKey) > 0 || len(o.SecretKey) > 0:
+		return &StaticCredentials{AccessKey: o.AccessKey, SecretKey: o.SecretKey}
 	}
+	return DefaultCredentials()
 }
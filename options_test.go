@@ -1,6 +1,7 @@
 package dlog
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -30,3 +31,58 @@ func TestOptionsStreamName(t *testing.T) {
 	assert.Nil(e)
 	assert.Equal("dev--github.com-topicai-dlog.impression--12345", n)
 }
+
+func TestResolveRegion(t *testing.T) {
+	assert := assert.New(t)
+
+	r, e := resolveRegion("cn-north-1", "")
+	assert.Nil(e)
+	assert.Equal("https://kinesis.cn-north-1.amazonaws.com.cn", r.KinesisEndpoint)
+
+	r, e = resolveRegion("ap-southeast-7", "")
+	assert.Nil(e)
+	assert.Equal("ap-southeast-7", r.Name)
+	assert.Equal("https://kinesis.ap-southeast-7.amazonaws.com", r.KinesisEndpoint)
+
+	r, e = resolveRegion("us-isob-east-1", "")
+	assert.Nil(e)
+	assert.Equal("https://kinesis.us-isob-east-1.sc2s.sgov.gov", r.KinesisEndpoint)
+
+	RegisterPartition("eusc-", "amazonaws.eu")
+	defer func() {
+		partitionsLock.Lock()
+		defer partitionsLock.Unlock()
+		delete(partitions, "eusc-")
+		delete(registeredPartitions, "eusc-")
+	}()
+	r, e = resolveRegion("eusc-de-east-1", "")
+	assert.Nil(e)
+	assert.Equal("https://kinesis.eusc-de-east-1.amazonaws.eu", r.KinesisEndpoint)
+
+	// Local emulators.
+	r, e = resolveRegion("", "http://localhost:4567")
+	assert.Nil(e)
+	assert.Equal("us-east-1", r.Name)
+	assert.Equal("http://localhost:4567", r.KinesisEndpoint)
+
+	// Typos of regions fail, unless registered.
+	_, e = resolveRegion("us-esat-1", "")
+	assert.True(errors.Is(e, ErrUnknownRegion))
+	RegisterRegion("ap-future-1")
+	defer func() {
+		partitionsLock.Lock()
+		defer partitionsLock.Unlock()
+		delete(regions, "ap-future-1")
+	}()
+	r, e = resolveRegion("ap-future-1", "")
+	assert.Nil(e)
+	assert.Equal("https://kinesis.ap-future-1.amazonaws.com", r.KinesisEndpoint)
+
+	for _, name := range []string{"", "mars", "US East"} {
+		_, e = resolveRegion(name, "")
+		assert.True(errors.Is(e, ErrUnknownRegion), name)
+	}
+
+	_, e = (&Options{Region: "mars"}).kinesis()
+	assert.True(errors.Is(e, ErrUnknownRegion))
+}
@@ -0,0 +1,75 @@
+package dlog
+
+import "sync"
+
+// pipeline limits the number of batches being sent to Kinesis
+// concurrently.  It also keeps any partition key out of two
+// concurrent batches, so records of the same key arrive in order.
+type pipeline struct {
+	maxInFlight int
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	inFlight int
+	keys     map[string]bool // Partition keys of in-flight batches.
+}
+
+func newPipeline(maxInFlight int) *pipeline {
+	if maxInFlight <= 0 {
+		maxInFlight = 1
+	}
+
+	p := &pipeline{
+		maxInFlight: maxInFlight,
+		keys:        make(map[string]bool),
+	}
+	p.cond = sync.NewCond(&p.lock)
+	return p
+}
+
+// acquire blocks until a batch with the given partition keys can be
+// sent.
+func (p *pipeline) acquire(keys map[string]bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for p.inFlight >= p.maxInFlight || p.conflicts(keys) {
+		p.cond.Wait()
+	}
+
+	p.inFlight++
+	for k := range keys {
+		p.keys[k] = true
+	}
+}
+
+// release is called after sending a batch acquired with keys.
+func (p *pipeline) release(keys map[string]bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.inFlight--
+	for k := range keys {
+		delete(p.keys, k)
+	}
+	p.cond.Broadcast()
+}
+
+// wait blocks until all in-flight batches are sent.
+func (p *pipeline) wait() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for p.inFlight > 0 {
+		p.cond.Wait()
+	}
+}
+
+func (p *pipeline) conflicts(keys map[string]bool) bool {
+	for k := range keys {
+		if p.keys[k] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package dlog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineKeepsKeysInOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	p := newPipeline(3)
+	a := map[string]bool{"a": true}
+	b := map[string]bool{"b": true}
+	ab := map[string]bool{"a": true, "b": true}
+
+	p.acquire(a)
+	p.acquire(b) // Different keys are sent concurrently.
+
+	acquired := make(chan bool)
+	go func() {
+		p.acquire(ab)
+		acquired <- true
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("batches of the same key are sent concurrently")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	p.release(a)
+	select {
+	case <-acquired:
+		t.Fatal("batches of the same key are sent concurrently")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	p.release(b)
+	assert.True(<-acquired)
+
+	p.release(ab)
+	p.wait()
+	assert.Equal(0, len(p.keys))
+}
+
+func TestPipelineMaxInFlight(t *testing.T) {
+	p := newPipeline(0) // Means 1.
+	p.acquire(map[string]bool{"a": true})
+
+	acquired := make(chan bool)
+	go func() {
+		p.acquire(map[string]bool{"b": true})
+		acquired <- true
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("more batches in flight than MaxInFlight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	p.release(map[string]bool{"a": true})
+	<-acquired
+}
@@ -0,0 +1,62 @@
+package dlog
+
+import (
+	"context"
+	"fmt"
+)
+
+// Priority decides which messages Logger drops first when the queue
+// is full.  Messages of higher priority never make room for those of
+// lower priority.
+type Priority int
+
+const (
+	// BestEffort messages are dropped first.
+	BestEffort Priority = iota - 1
+
+	// Normal is the default priority.
+	Normal
+
+	// Critical messages are spilled into Options.SpillDir, if set,
+	// instead of being dropped or blocked.
+	Critical
+)
+
+func (p Priority) String() string {
+	switch p {
+	case BestEffort:
+		return "best-effort"
+	case Normal:
+		return "normal"
+	case Critical:
+		return "critical"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// Prioritizer is implemented by message types that declare their
+// priority.
+type Prioritizer interface {
+	Priority() Priority
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a context, with which Logger.LogContext and
+// Logger.LogSync log messages in priority p.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priority returns the priority of logging msg with ctx, which is the
+// first defined of the priority in ctx, that declared by msg, and the
+// default of the Logger.
+func priority(ctx context.Context, msg interface{}, defaultPriority Priority) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	if p, ok := msg.(Prioritizer); ok {
+		return p.Priority()
+	}
+	return defaultPriority
+}
@@ -0,0 +1,120 @@
+package dlog
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type billingClick struct {
+	Session string
+}
+
+func (billingClick) Priority() Priority { return Critical }
+
+func TestPriorityOfMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	assert.Equal(Normal, priority(ctx, click{}, Normal))
+	assert.Equal(BestEffort, priority(ctx, click{}, BestEffort))
+	assert.Equal(Critical, priority(ctx, billingClick{}, BestEffort))
+	assert.Equal(BestEffort, priority(WithPriority(ctx, BestEffort), billingClick{}, Normal))
+	assert.Equal(Priority(0), Normal)
+}
+
+func testPriorityRecord(s string, p Priority) *record {
+	return &record{data: []byte(s), priority: p}
+}
+
+func TestQueueShedsLowerPriorities(t *testing.T) {
+	assert := assert.New(t)
+
+	q, dropped := newTestQueue(3, 100, Block, nil)
+	for _, r := range []*record{
+		testPriorityRecord("a", Normal),
+		testPriorityRecord("b", BestEffort),
+		testPriorityRecord("c", BestEffort),
+	} {
+		_, e := q.push(r)
+		assert.Nil(e)
+	}
+
+	// Higher priorities make room by dropping lowest and oldest first.
+	wait, e := q.push(testPriorityRecord("d", Critical))
+	assert.Nil(wait)
+	assert.Nil(e)
+	assert.Equal("b", string((*dropped)[0].data))
+
+	// Same priorities block.
+	wait, _ = q.push(testPriorityRecord("e", BestEffort))
+	assert.NotNil(wait)
+
+	// DropOldest never drops higher priorities to make room.
+	q, dropped = newTestQueue(2, 100, DropOldest, nil)
+	q.push(testPriorityRecord("a", Critical))
+	q.push(testPriorityRecord("b", Normal))
+	_, e = q.push(testPriorityRecord("c", Normal))
+	assert.Nil(e)
+	assert.Equal("b", string((*dropped)[0].data))
+	_, e = q.push(testPriorityRecord("d", BestEffort))
+	assert.True(errors.Is(e, ErrDropped))
+	assert.Equal("a", string(q.pop().data))
+	assert.Equal("c", string(q.pop().data))
+}
+
+func TestQueueSpillsCriticalRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+
+	spill, e := openSpillFile(dir, "stream")
+	assert.Nil(e)
+
+	q, dropped := newTestQueue(1, 100, DropNewest, spill)
+	q.push(testPriorityRecord("a", Critical))
+	_, e = q.push(testPriorityRecord("b", Critical))
+	assert.Nil(e)
+	assert.Equal(1, spill.len())
+	_, e = q.push(testPriorityRecord("c", Normal))
+	assert.True(errors.Is(e, ErrDropped))
+	assert.Equal(1, len(*dropped))
+
+	// Spilled critical records keep their order and priority.
+	assert.Equal("a", string(q.pop().data))
+	_, e = q.push(testPriorityRecord("d", Normal))
+	assert.Nil(e)
+	r := q.pop()
+	assert.Equal("b", string(r.data))
+	assert.Equal(Critical, r.priority)
+	assert.Equal("d", string(q.pop().data))
+	assert.Nil(q.pop())
+	assert.Nil(spill.close())
+}
+
+func TestLoggerMetricsByPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	l, e := NewLogger(&impression{}, &Options{
+		BatchAge:       100 * time.Millisecond,
+		Priority:       BestEffort,
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+
+	assert.Nil(l.LogSync(context.Background(), impression{}))
+	assert.Nil(l.LogSync(WithPriority(context.Background(), Critical), impression{}))
+	assert.Nil(l.Close())
+
+	assert.Equal("1", l.writtenByPriority.Get("best-effort").String())
+	assert.Equal("1", l.writtenByPriority.Get("critical").String())
+}
@@ -0,0 +1,440 @@
+package dlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Default capacity of the queue between Logger.Log and the sync
+	// goroutine.
+	defaultQueueLength = 10000
+	defaultQueueBytes  = 2 * maxBatchSize
+
+	// Each frame in a spill file is the record size followed by the
+	// record.
+	frameHeaderSize = 4
+
+	// A spilled record starts with its priority, enqueue time in Unix
+	// nanoseconds, and the length of its partition key, followed by
+	// the key and the data.
+	spillHeaderSize = 1 + 8 + 1
+)
+
+// OverflowPolicy decides what Logger.Log does when the queue is full.
+type OverflowPolicy int
+
+const (
+	// Block waits until the sync goroutine makes room in the queue,
+	// for at most Options.WriteTimeout.
+	Block OverflowPolicy = iota
+
+	// DropNewest drops the message being logged, and Log returns
+	// ErrDropped.
+	DropNewest
+
+	// DropOldest drops the oldest messages in the queue to make room
+	// for the message being logged.
+	DropOldest
+
+	// SpillToDisk appends messages to a file in Options.SpillDir
+	// until the sync goroutine catches up.  The file is replayed by
+	// the next Logger of the same stream if the process exits before
+	// that.
+	SpillToDisk
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case SpillToDisk:
+		return "spill"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// queue is a FIFO of records bounded by both the number of records
+// and their total size.  Many goroutines push into it, and the sync
+// goroutine pops from it.
+type queue struct {
+	maxLen   int
+	maxBytes int
+	policy   OverflowPolicy
+	spill    *spillFile // Not nil only if policy is SpillToDisk.
+
+	// Called with lock held for each dropped and spilled record.
+	onDrop  func(*record)
+	onSpill func(*record)
+
+	lock    sync.Mutex
+	records []*record
+	bytes   int
+	closed  bool
+	pushed  uint64 // Numbers records in memory and spilled in order.
+
+	ready  chan struct{} // Signaled after each push.
+	popped chan struct{} // Closed and replaced after each pop.
+}
+
+func newQueue(maxLen, maxBytes int, policy OverflowPolicy, spill *spillFile,
+	onDrop, onSpill func(*record)) *queue {
+	if maxLen <= 0 {
+		maxLen = defaultQueueLength
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultQueueBytes
+	}
+
+	return &queue{
+		maxLen:   maxLen,
+		maxBytes: maxBytes,
+		policy:   policy,
+		spill:    spill,
+		onDrop:   onDrop,
+		onSpill:  onSpill,
+		ready:    make(chan struct{}, 1),
+		popped:   make(chan struct{}),
+	}
+}
+
+// push adds r into the queue, or handles the overflow following the
+// policy.  It returns ErrDropped if r is dropped.  If the policy is
+// Block and the queue is full, push returns a channel closed after
+// the next pop, so the caller can wait and retry.
+func (q *queue) push(r *record) (wait <-chan struct{}, e error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return nil, ErrClosed
+	}
+
+	switch {
+	case q.policy == SpillToDisk && q.spill.len() > 0:
+		// Keep spilling until the spill file is drained, so records
+		// keep their order.
+		e = q.spillRecord(r)
+
+	case q.fits(r):
+		q.append(r)
+
+	case q.shed(r, false):
+		q.append(r)
+
+	case r.priority >= Critical && q.spill != nil:
+		e = q.spillRecord(r)
+
+	case q.policy == Block:
+		return q.popped, nil
+
+	case q.policy == DropNewest:
+		q.onDrop(r)
+		return nil, ErrDropped
+
+	case q.policy == DropOldest:
+		if !q.shed(r, true) {
+			q.onDrop(r) // All queued records have higher priorities.
+			return nil, ErrDropped
+		}
+		q.append(r)
+
+	case q.policy == SpillToDisk:
+		e = q.spillRecord(r)
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil, e
+}
+
+// pop returns the oldest record, or nil if the queue is empty.
+// Records are popped in the order they were pushed, whether they are
+// in memory or spilled, so records of the same partition key keep
+// their order.  Records replayed from the spill file of a previous
+// run come first.
+func (q *queue) pop() *record {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.spill != nil && q.spill.len() > 0 && (len(q.records) == 0 || q.spill.next() < q.records[0].order) {
+		r, e := q.spill.read()
+		if e != nil {
+			log.Printf("dlog cannot read spill file: %v", e)
+		}
+		if r != nil {
+			return r
+		}
+	}
+
+	if len(q.records) > 0 {
+		return q.shift()
+	}
+	return nil
+}
+
+// close makes further pushes return ErrClosed.  Records in the queue
+// can still be popped.
+func (q *queue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+}
+
+func (q *queue) fits(r *record) bool {
+	// A record larger than maxBytes fits into an empty queue.
+	return len(q.records) == 0 ||
+		(len(q.records) < q.maxLen && q.bytes+len(r.data) <= q.maxBytes)
+}
+
+func (q *queue) append(r *record) {
+	q.pushed++
+	r.order = q.pushed
+	q.records = append(q.records, r)
+	q.bytes += len(r.data)
+}
+
+func (q *queue) shift() *record {
+	r := q.records[0]
+	q.records[0] = nil
+	q.records = q.records[1:]
+	return q.removed(r)
+}
+
+func (q *queue) remove(i int) *record {
+	r := q.records[i]
+	copy(q.records[i:], q.records[i+1:])
+	q.records[len(q.records)-1] = nil
+	q.records = q.records[:len(q.records)-1]
+	return q.removed(r)
+}
+
+func (q *queue) removed(r *record) *record {
+	q.bytes -= len(r.data)
+	close(q.popped)
+	q.popped = make(chan struct{})
+	return r
+}
+
+// shed drops records of lower priorities than r, or also of the same
+// priority if samePriority, lowest and oldest first, to make room for
+// r.  It drops nothing and returns false if that is not enough.
+func (q *queue) shed(r *record, samePriority bool) bool {
+	sheddable := func(p Priority) bool {
+		return p < r.priority || (samePriority && p == r.priority)
+	}
+
+	n, bytes := len(q.records), q.bytes
+	for _, x := range q.records {
+		if sheddable(x.priority) {
+			n--
+			bytes -= len(x.data)
+		}
+	}
+	if n > 0 && (n >= q.maxLen || bytes+len(r.data) > q.maxBytes) {
+		return false
+	}
+
+	for !q.fits(r) {
+		lowest := -1
+		for i, x := range q.records {
+			if sheddable(x.priority) && (lowest < 0 || x.priority < q.records[lowest].priority) {
+				lowest = i
+			}
+		}
+		q.onDrop(q.remove(lowest))
+	}
+	return true
+}
+
+func (q *queue) spillRecord(r *record) error {
+	q.pushed++
+	r.order = q.pushed
+	if e := q.spill.write(r); e != nil {
+		log.Printf("dlog cannot write spill file: %v", e)
+		q.onDrop(r)
+		return ErrDropped
+	}
+	q.onSpill(r)
+	return nil
+}
+
+// spillFile is a file of frames of records written after the queue
+// is full.  Frames are read from the head and written to the tail,
+// and the file is truncated once all frames are read.
+type spillFile struct {
+	f           *os.File
+	readOffset  int64
+	writeOffset int64
+	pending     []spilled // Of every frame not read yet.
+}
+
+// spilled keeps the fields of a spilled record that live only in
+// memory.  Frames replayed from a previous run have a zero order and
+// no sent.
+type spilled struct {
+	order uint64
+	sent  chan error
+}
+
+// openSpillFile opens the spill file of a stream, which might include
+// frames from a previous run.
+func openSpillFile(dir, streamName string) (*spillFile, error) {
+	if len(dir) <= 0 {
+		return nil, fmt.Errorf("Options.SpillDir mustn't be empty if OverflowPolicy is SpillToDisk")
+	}
+
+	f, e := os.OpenFile(filepath.Join(dir, streamName+".spill"), os.O_RDWR|os.O_CREATE, 0644)
+	if e != nil {
+		return nil, e
+	}
+
+	s := &spillFile{f: f}
+	for {
+		data, e := readFrame(io.NewSectionReader(f, s.writeOffset, 1<<62))
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			// Drop the partially written frame at the tail.
+			log.Printf("dlog truncates spill file %s: %v", f.Name(), e)
+			if e := f.Truncate(s.writeOffset); e != nil {
+				f.Close()
+				return nil, e
+			}
+			break
+		}
+		s.writeOffset += frameHeaderSize + int64(len(data))
+		s.pending = append(s.pending, spilled{})
+	}
+	return s, nil
+}
+
+func (s *spillFile) len() int {
+	return len(s.pending)
+}
+
+// next returns the order of the next record to read.
+func (s *spillFile) next() uint64 {
+	return s.pending[0].order
+}
+
+func (s *spillFile) write(r *record) error {
+	buf := appendFrame(nil, encodeSpilled(r))
+	if _, e := s.f.WriteAt(buf, s.writeOffset); e != nil {
+		return e
+	}
+
+	s.writeOffset += int64(len(buf))
+	s.pending = append(s.pending, spilled{order: r.order, sent: r.sent})
+	return nil
+}
+
+func (s *spillFile) read() (*record, error) {
+	data, e := readFrame(io.NewSectionReader(s.f, s.readOffset, s.writeOffset-s.readOffset))
+	var r *record
+	if e == nil {
+		r, e = decodeSpilled(data)
+	}
+	if e != nil {
+		// The rest of the file is unreadable, so drop it.
+		s.pending = nil
+		return nil, s.reset(e)
+	}
+
+	r.order, r.sent = s.pending[0].order, s.pending[0].sent
+	s.readOffset += frameHeaderSize + int64(len(data))
+	s.pending = s.pending[1:]
+
+	if len(s.pending) == 0 {
+		return r, s.reset(nil)
+	}
+	return r, nil
+}
+
+func encodeSpilled(r *record) []byte {
+	buf := make([]byte, spillHeaderSize, spillHeaderSize+len(r.key)+len(r.data))
+	buf[0] = byte(r.priority)
+	binary.BigEndian.PutUint64(buf[1:9], uint64(r.enqueued.UnixNano()))
+	buf[9] = byte(len(r.key)) // Keys are at most partitionKeySize bytes.
+	return append(append(buf, r.key...), r.data...)
+}
+
+func decodeSpilled(data []byte) (*record, error) {
+	if len(data) < spillHeaderSize || len(data) < spillHeaderSize+int(data[9]) {
+		return nil, errors.New("dlog spill frame shorter than its header")
+	}
+
+	keyEnd := spillHeaderSize + int(data[9])
+	return &record{
+		data:     data[keyEnd:],
+		key:      string(data[spillHeaderSize:keyEnd]),
+		priority: Priority(int8(data[0])),
+		enqueued: time.Unix(0, int64(binary.BigEndian.Uint64(data[1:9]))),
+	}, nil
+}
+
+func (s *spillFile) reset(cause error) error {
+	s.readOffset, s.writeOffset = 0, 0
+	if e := s.f.Truncate(0); e != nil {
+		return e
+	}
+	return cause
+}
+
+// close closes the spill file, and removes it if all frames were
+// read.
+func (s *spillFile) close() error {
+	if e := s.f.Close(); e != nil {
+		return e
+	}
+
+	if s.len() == 0 {
+		return os.Remove(s.f.Name())
+	}
+	return nil
+}
+
+// appendFrame appends to buf the size of data in big endian, followed
+// by data.
+func appendFrame(buf, data []byte) []byte {
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	return append(append(buf, header[:]...), data...)
+}
+
+// readFrame reads a frame written by appendFrame.  It returns io.EOF
+// if there are no more frames, and io.ErrUnexpectedEOF if the frame
+// is truncated.
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, e := io.ReadFull(r, header[:]); e != nil {
+		return nil, e
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxMessageSize+spillHeaderSize+partitionKeySize {
+		return nil, errors.New("dlog frame larger than the maximum message size")
+	}
+
+	data := make([]byte, size)
+	if _, e := io.ReadFull(r, data); e != nil {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return nil, e
+	}
+	return data, nil
+}
@@ -0,0 +1,258 @@
+package dlog
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestQueue(maxLen, maxBytes int, policy OverflowPolicy, spill *spillFile) (*queue, *[]*record) {
+	dropped := make([]*record, 0)
+	q := newQueue(maxLen, maxBytes, policy, spill,
+		func(r *record) { dropped = append(dropped, r) },
+		func(*record) {})
+	return q, &dropped
+}
+
+func testRecord(s string) *record {
+	return &record{data: []byte(s)}
+}
+
+func TestQueueBlock(t *testing.T) {
+	assert := assert.New(t)
+
+	q, _ := newTestQueue(2, 100, Block, nil)
+	for _, s := range []string{"a", "b"} {
+		wait, e := q.push(testRecord(s))
+		assert.Nil(wait)
+		assert.Nil(e)
+	}
+
+	wait, e := q.push(testRecord("c"))
+	assert.Nil(e)
+	assert.NotNil(wait)
+
+	assert.Equal("a", string(q.pop().data))
+	select {
+	case <-wait:
+	default:
+		t.Error("pop doesn't wake up blocked push")
+	}
+
+	wait, e = q.push(testRecord("c"))
+	assert.Nil(wait)
+	assert.Nil(e)
+}
+
+func TestQueueBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	q, dropped := newTestQueue(100, 4, DropNewest, nil)
+
+	// A record larger than maxBytes fits into an empty queue.
+	_, e := q.push(testRecord("abcdef"))
+	assert.Nil(e)
+
+	_, e = q.push(testRecord("g"))
+	assert.True(errors.Is(e, ErrDropped))
+	assert.Equal(1, len(*dropped))
+
+	q.pop()
+	_, e = q.push(testRecord("ab"))
+	assert.Nil(e)
+	_, e = q.push(testRecord("cd"))
+	assert.Nil(e)
+	_, e = q.push(testRecord("e"))
+	assert.True(errors.Is(e, ErrDropped))
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	assert := assert.New(t)
+
+	q, dropped := newTestQueue(2, 100, DropOldest, nil)
+	for _, s := range []string{"a", "b", "c", "d"} {
+		_, e := q.push(testRecord(s))
+		assert.Nil(e)
+	}
+
+	assert.Equal(2, len(*dropped))
+	assert.Equal("a", string((*dropped)[0].data))
+	assert.Equal("c", string(q.pop().data))
+	assert.Equal("d", string(q.pop().data))
+	assert.Nil(q.pop())
+}
+
+func TestQueueSpillToDisk(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+
+	spill, e := openSpillFile(dir, "stream")
+	assert.Nil(e)
+
+	q, dropped := newTestQueue(1, 100, SpillToDisk, spill)
+	for _, s := range []string{"a", "b", "c"} {
+		_, e := q.push(testRecord(s))
+		assert.Nil(e)
+	}
+	assert.Equal(0, len(*dropped))
+	assert.Equal(2, spill.len())
+
+	// Records keep their order across memory and disk.
+	assert.Equal("a", string(q.pop().data))
+	assert.Equal("b", string(q.pop().data))
+	_, e = q.push(testRecord("d"))
+	assert.Nil(e)
+	assert.Equal("c", string(q.pop().data))
+	assert.Equal("d", string(q.pop().data))
+	assert.Nil(q.pop())
+
+	// The next run replays records left in the spill file.
+	_, e = q.push(testRecord("e"))
+	assert.Nil(e)
+	_, e = q.push(testRecord("f"))
+	assert.Nil(e)
+	assert.Nil(spill.close())
+
+	spill, e = openSpillFile(dir, "stream")
+	assert.Nil(e)
+	assert.Equal(1, spill.len())
+	q, _ = newTestQueue(1, 100, SpillToDisk, spill)
+	assert.Equal("f", string(q.pop().data))
+	assert.Nil(spill.close())
+
+	_, e = os.Stat(spill.f.Name())
+	assert.True(os.IsNotExist(e))
+
+	_, e = openSpillFile("", "stream")
+	assert.NotNil(e)
+}
+
+func TestSpillFileKeepsRecordFields(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+
+	spill, e := openSpillFile(dir, "stream")
+	assert.Nil(e)
+
+	enqueued := time.Now()
+	key := strings.Repeat("k", partitionKeySize)
+	assert.Nil(spill.write(&record{data: []byte("a"), key: key, priority: Critical, enqueued: enqueued}))
+	assert.Nil(spill.write(&record{data: []byte{}, key: "", priority: BestEffort, enqueued: enqueued}))
+
+	r, e := spill.read()
+	assert.Nil(e)
+	assert.Equal("a", string(r.data))
+	assert.Equal(key, r.key)
+	assert.Equal(Critical, r.priority)
+	assert.True(enqueued.Equal(r.enqueued))
+
+	r, e = spill.read()
+	assert.Nil(e)
+	assert.Equal(0, len(r.data))
+	assert.Equal("", r.key)
+	assert.Equal(BestEffort, r.priority)
+	assert.Nil(spill.close())
+}
+
+func TestLoggerSpillKeepsPartitionKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+
+	l, e := NewLogger(&impression{}, &Options{
+		QueueLength:    1,
+		OverflowPolicy: SpillToDisk,
+		SpillDir:       dir,
+		SyncPeriod:     10 * time.Millisecond,
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		assert.Nil(l.Log(impression{Query: strconv.Itoa(i)}))
+	}
+	assert.Nil(l.Close())
+	assert.True(l.spilledRecords.Value() > 0)
+
+	n := 0
+	for _, batch := range l.kinesis.(*kinesisMock).storage[l.streamName] {
+		for _, r := range batch {
+			assert.Equal(32, len(r.PartitionKey))
+			n++
+		}
+	}
+	assert.Equal(50, n)
+
+	// Queue times of spilled records are measured from Log.
+	assert.True(l.queueTime.max >= 0 && l.queueTime.max <= time.Since(start))
+	assert.True(l.queueTime.sum >= 0)
+}
+
+func TestFrames(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := appendFrame(nil, []byte("hello"))
+	buf = appendFrame(buf, []byte{})
+
+	r := bytes.NewReader(buf)
+	data, e := readFrame(r)
+	assert.Nil(e)
+	assert.Equal("hello", string(data))
+	data, e = readFrame(r)
+	assert.Nil(e)
+	assert.Equal(0, len(data))
+	_, e = readFrame(r)
+	assert.Equal(io.EOF, e)
+
+	_, e = readFrame(bytes.NewReader(buf[:6]))
+	assert.Equal(io.ErrUnexpectedEOF, e)
+}
+
+func TestLoggerOverflowPolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, policy := range []OverflowPolicy{DropNewest, DropOldest} {
+		l, e := NewLogger(&impression{}, &Options{
+			SyncPeriod:     10000 * time.Second,
+			QueueLength:    1,
+			OverflowPolicy: policy,
+			UseMockKinesis: true,
+			MockKinesis:    newKinesisMock(600 * time.Second), // Block the sync goroutine.
+		})
+		assert.Nil(e)
+		assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+
+		// The sync goroutine takes at most maxBatchSize bytes before
+		// blocking in PutRecords, and the queue holds one more
+		// message, so others are dropped.
+		big := &impression{Results: []string{string(make([]byte, maxMessageSize/2))}}
+		for i := 0; i < 20; i++ {
+			e = l.Log(big)
+			if policy == DropNewest && e != nil {
+				assert.True(errors.Is(e, ErrDropped))
+				break
+			}
+		}
+		dropped, _ := strconv.Atoi(l.droppedRecords.Get(policy.String()).String())
+		assert.True(dropped > 0, policy.String())
+	}
+}
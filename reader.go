@@ -0,0 +1,217 @@
+package dlog
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ReaderOptions configures a Reader.
+type ReaderOptions struct {
+	// Name prefixes the names of metrics of the Reader, like the
+	// stream name prefixes those of Logger.
+	Name string
+
+	// Keys decrypts records encrypted by Loggers with
+	// Options.EncryptionKeys.
+	Keys KeyProvider
+
+	// If SigningKeys is not nil, records not signed by one of its
+	// keys, including unsigned records, are counted in the metric
+	// invalidSignatures.  If RejectInvalidSignatures, Reader also
+	// returns an error matching ErrInvalidSignature for them.
+	SigningKeys             KeyProvider
+	RejectInvalidSignatures bool
+
+	// If LossReportPeriod > 0, the loss report of every producer is
+	// logged every period until the Reader is closed.
+	LossReportPeriod time.Duration
+
+	// If Dedup is not nil, Reader drops records whose IDs it has
+	// seen within its window.
+	Dedup *DedupFilter
+}
+
+// Reader is the consumer side of dlog.  It opens and decodes Kinesis
+// records written by Logger.
+type Reader struct {
+	*ReaderOptions
+	sequences  *sequenceTracker  // nil for plainReader.
+	heartbeats *heartbeatTracker // nil for plainReader.
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// dlog exposed runtime metrics
+	invalidSignatures *expvar.Int
+	missingRecords    *expvar.Map // Keyed by producer ID.
+	duplicateRecords  *expvar.Map
+	reorderedRecords  *expvar.Map
+	droppedDuplicates *expvar.Int // By Dedup.
+	lastHeard         *expvar.Map // Unix time of the last heartbeat, keyed by producer ID.
+	heartbeatLatency  *expvar.Map // Milliseconds, keyed by producer ID.
+}
+
+// plainReader opens records without keys, for the function Decode.
+var plainReader = &Reader{ReaderOptions: &ReaderOptions{}}
+
+func NewReader(opts *ReaderOptions) *Reader {
+	if opts == nil {
+		opts = &ReaderOptions{}
+	}
+
+	n, createdTime := opts.Name, time.Now().UnixNano()
+	r := &Reader{
+		ReaderOptions: opts,
+		sequences:     newSequenceTracker(),
+		heartbeats:    newHeartbeatTracker(),
+		done:          make(chan struct{}),
+
+		invalidSignatures: expvar.NewInt(fmt.Sprintf("%v--invalidSignatures--%v", n, createdTime)),
+		missingRecords:    expvar.NewMap(fmt.Sprintf("%v--missingRecords--%v", n, createdTime)),
+		duplicateRecords:  expvar.NewMap(fmt.Sprintf("%v--duplicateRecords--%v", n, createdTime)),
+		reorderedRecords:  expvar.NewMap(fmt.Sprintf("%v--reorderedRecords--%v", n, createdTime)),
+		droppedDuplicates: expvar.NewInt(fmt.Sprintf("%v--droppedDuplicates--%v", n, createdTime)),
+		lastHeard:         expvar.NewMap(fmt.Sprintf("%v--lastHeard--%v", n, createdTime)),
+		heartbeatLatency:  expvar.NewMap(fmt.Sprintf("%v--heartbeatLatency--%v", n, createdTime)),
+	}
+
+	if opts.LossReportPeriod > 0 {
+		go r.reportLoss()
+	}
+	return r
+}
+
+// Close stops the periodic loss report.
+func (r *Reader) Close() error {
+	r.closeOnce.Do(func() { close(r.done) })
+	return nil
+}
+
+// LossReport returns the loss report of every producer seen by the
+// Reader, sorted by producer ID.  Missing records are only lost if
+// the Reader reads the stream from the beginning, like from
+// TRIM_HORIZON.
+func (r *Reader) LossReport() []ProducerLoss {
+	return r.sequences.report()
+}
+
+// Freshness returns when the Reader last heard from every producer
+// with heartbeats, sorted by producer ID.  A Reader of some shards of
+// a stream only sees heartbeats of producers whose IDs map to the
+// shards.
+func (r *Reader) Freshness() []ProducerFreshness {
+	return r.heartbeats.report()
+}
+
+func (r *Reader) reportLoss() {
+	ticker := time.NewTicker(r.LossReportPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, p := range r.LossReport() {
+				log.Printf("dlog loss report of %s: %v", r.Name, p)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Open returns the envelope of a Kinesis record, with the signature
+// verified and the message decrypted.  It returns an error matching
+// ErrDuplicate if ReaderOptions.Dedup has seen the record.
+func (r *Reader) Open(data []byte) (*Envelope, error) {
+	env, e := OpenEnvelope(data)
+	if e != nil {
+		return nil, e
+	}
+
+	if r.SigningKeys != nil {
+		if e := verifyEnvelope(env, r.SigningKeys); e != nil {
+			r.invalidSignatures.Add(1)
+			if r.RejectInvalidSignatures {
+				return nil, e
+			}
+		}
+	}
+
+	if e := decryptEnvelope(env, r.Keys); e != nil {
+		return nil, e
+	}
+
+	if r.sequences != nil && len(env.ProducerID) > 0 && env.Heartbeat == nil {
+		r.observeSeq(env)
+	}
+
+	if r.heartbeats != nil && env.Heartbeat != nil {
+		f := r.heartbeats.observe(env, time.Now())
+		lastHeard, latency := new(expvar.Int), new(expvar.Float)
+		lastHeard.Set(f.LastHeard.Unix())
+		latency.Set(milliseconds(f.Latency))
+		r.lastHeard.Set(f.ProducerID, lastHeard)
+		r.heartbeatLatency.Set(f.ProducerID, latency)
+	}
+
+	if r.Dedup != nil && len(env.RecordID) > 0 && !r.Dedup.add(env.RecordID) {
+		r.droppedDuplicates.Add(1)
+		return nil, fmt.Errorf("%w %s", ErrDuplicate, env.RecordID)
+	}
+	return env, nil
+}
+
+func (r *Reader) observeSeq(env *Envelope) {
+	switch kind, n := r.sequences.observe(env.ProducerID, env.Seq, time.Now()); kind {
+	case "missing":
+		r.missingRecords.Add(env.ProducerID, n)
+	case "reordered":
+		r.missingRecords.Add(env.ProducerID, -1)
+		r.reorderedRecords.Add(env.ProducerID, 1)
+	case "duplicate":
+		r.duplicateRecords.Add(env.ProducerID, 1)
+	}
+}
+
+// Decode is like the function Decode, but it opens the record with
+// the keys of the Reader.  It returns ErrHeartbeat for heartbeat
+// records.
+func (r *Reader) Decode(typeName string, data []byte) (interface{}, error) {
+	env, e := r.Open(data)
+	if e != nil {
+		return nil, e
+	}
+	if env.Heartbeat != nil {
+		return nil, ErrHeartbeat
+	}
+	return decodeMessage(typeName, env.Message)
+}
+
+// Handle decodes a Kinesis record and calls h with the message and
+// its envelope.  Duplicates and heartbeats are skipped.  If h fails,
+// the record is removed from ReaderOptions.Dedup, so that it is
+// handled again when the consumer retries it.
+func (r *Reader) Handle(typeName string, data []byte, h func(msg interface{}, env *Envelope) error) error {
+	env, e := r.Open(data)
+	if errors.Is(e, ErrDuplicate) {
+		return nil
+	} else if e != nil {
+		return e
+	}
+	if env.Heartbeat != nil {
+		return nil
+	}
+
+	msg, e := decodeMessage(typeName, env.Message)
+	if e == nil {
+		e = h(msg, env)
+	}
+	if e != nil && r.Dedup != nil && len(env.RecordID) > 0 {
+		r.Dedup.remove(env.RecordID)
+	}
+	return e
+}
@@ -0,0 +1,381 @@
+package dlog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Actions of the dlog struct tag, which Logger applies to fields of
+// messages before encoding them:
+//
+//	Query   string `dlog:"redact"` // Replaced by "[REDACTED]", or zero if not a string.
+//	Session string `dlog:"hash"`   // Replaced by hex-encoded HMAC-SHA256 keyed by Options.HashKey.
+//	Debug   string `dlog:"omit"`   // Not written.
+//
+// The tag also applies to fields of nested structs, pointers to
+// structs, slices, arrays and map values of them, and to the concrete
+// values of interface fields.
+const (
+	tagRedact = "redact"
+	tagHash   = "hash"
+	tagOmit   = "omit"
+
+	redacted = "[REDACTED]"
+)
+
+// redactionPlan lists the fields of a struct type to transform.
+type redactionPlan struct {
+	fields []fieldAction
+	built  bool // False while fields are being filled.
+}
+
+type fieldAction struct {
+	index   int
+	name    string
+	action  string         // One of the tag actions, or "" for nested.
+	nested  *redactionPlan // Plan of the nested struct type.
+	dynamic bool           // Interface field, planned by its value.
+}
+
+var (
+	redactionPlans     = make(map[reflect.Type]*redactionPlan)
+	redactionPlansLock sync.Mutex
+)
+
+// redactionPlanOf returns the cached plan of struct type t, or nil if
+// no field of t is tagged or holds interfaces.
+func redactionPlanOf(t reflect.Type) (*redactionPlan, error) {
+	redactionPlansLock.Lock()
+	defer redactionPlansLock.Unlock()
+
+	p, e := buildRedactionPlan(t)
+	if e != nil {
+		return nil, e
+	}
+	p.prune(make(map[*redactionPlan]bool))
+	if !p.needed() {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// redactionPlanOfValue returns the plan of the struct type of value
+// v, which might be a pointer to the struct, a slice, an array or a
+// map of them.
+func redactionPlanOfValue(v reflect.Value) (*redactionPlan, error) {
+	st := nestedStruct(v.Type())
+	if st == nil {
+		return nil, nil
+	}
+	return redactionPlanOf(st)
+}
+
+// buildRedactionPlan requires redactionPlansLock.  The plan is cached
+// before its fields are filled, so recursive types, including
+// mutually recursive ones, refer to it.
+func buildRedactionPlan(t reflect.Type) (*redactionPlan, error) {
+	if p, ok := redactionPlans[t]; ok {
+		return p, nil
+	}
+
+	p := &redactionPlan{}
+	redactionPlans[t] = p
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if len(f.PkgPath) > 0 {
+			continue // Gob ignores unexported fields.
+		}
+
+		switch tag := f.Tag.Get("dlog"); tag {
+		case tagRedact, tagOmit:
+			p.fields = append(p.fields, fieldAction{index: i, name: f.Name, action: tag})
+
+		case tagHash:
+			if f.Type.Kind() != reflect.String {
+				delete(redactionPlans, t)
+				return nil, fmt.Errorf("dlog:\"hash\" requires string field, but %v.%s is %v", t, f.Name, f.Type)
+			}
+			p.fields = append(p.fields, fieldAction{index: i, name: f.Name, action: tag})
+
+		case "":
+			if st := nestedStruct(f.Type); st != nil {
+				nested, e := buildRedactionPlan(st)
+				if e != nil {
+					delete(redactionPlans, t)
+					return nil, e
+				}
+				if len(nested.fields) > 0 || !nested.built {
+					p.fields = append(p.fields, fieldAction{index: i, name: f.Name, nested: nested})
+				}
+			} else if dynamicField(f.Type) {
+				p.fields = append(p.fields, fieldAction{index: i, name: f.Name, dynamic: true})
+			}
+
+		default:
+			delete(redactionPlans, t)
+			return nil, fmt.Errorf("Unknown dlog tag %q of %v.%s", tag, t, f.Name)
+		}
+	}
+	p.built = true
+	return p, nil
+}
+
+// prune drops nested fields of plans reachable from p whose plans
+// need no transformation.  Only plans of recursive types have them,
+// as they refer to plans still being built.  It requires
+// redactionPlansLock.
+func (p *redactionPlan) prune(visited map[*redactionPlan]bool) {
+	if visited[p] {
+		return
+	}
+	visited[p] = true
+
+	fields := make([]fieldAction, 0, len(p.fields))
+	for _, a := range p.fields {
+		if a.nested != nil {
+			if !a.nested.needed() {
+				continue
+			}
+			a.nested.prune(visited)
+		}
+		fields = append(fields, a)
+	}
+
+	// Plans in use by Loggers are already pruned, and not written.
+	if len(fields) < len(p.fields) {
+		p.fields = fields
+	}
+}
+
+// nestedStruct returns the struct type of a field of type t, which is
+// a struct, a pointer to it, or a slice, array or map of them.
+func nestedStruct(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Struct {
+		return t
+	}
+	return nil
+}
+
+// dynamicField returns whether a field of type t holds values of
+// types known only at run time: an interface, or a pointer, slice,
+// array or map of interfaces.
+func dynamicField(t reflect.Type) bool {
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Interface
+}
+
+// needed returns whether fields of p are tagged or hold interfaces.
+func (p *redactionPlan) needed() bool {
+	return p.any(func(a fieldAction) bool { return len(a.action) > 0 || a.dynamic }, make(map[*redactionPlan]bool))
+}
+
+func (p *redactionPlan) hashes() bool {
+	return p.any(func(a fieldAction) bool { return a.action == tagHash }, make(map[*redactionPlan]bool))
+}
+
+// tagged returns whether fields of p are tagged, not counting fields
+// of values of interface fields.
+func (p *redactionPlan) tagged() bool {
+	return p.any(func(a fieldAction) bool { return len(a.action) > 0 }, make(map[*redactionPlan]bool))
+}
+
+func (p *redactionPlan) any(f func(fieldAction) bool, visited map[*redactionPlan]bool) bool {
+	if visited[p] {
+		return false
+	}
+	visited[p] = true
+
+	for _, a := range p.fields {
+		if f(a) || (a.nested != nil && a.nested.any(f, visited)) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns a copy of msg with tagged fields transformed, and the
+// paths of transformed fields with their actions.  msg is not
+// modified.
+func (p *redactionPlan) apply(msg interface{}, key []byte) (interface{}, map[string]string) {
+	v := reflect.ValueOf(msg)
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return msg, nil
+	}
+
+	transformed := make(map[string]string)
+	cp := reflect.New(reflect.Indirect(v).Type())
+	cp.Elem().Set(reflect.Indirect(v))
+	p.transform(cp.Elem(), "", key, transformed)
+
+	if v.Kind() == reflect.Ptr {
+		return cp.Interface(), transformed
+	}
+	return cp.Elem().Interface(), transformed
+}
+
+// transform transforms the addressable struct value v.  Nested
+// pointers and slices are copied before being transformed.
+func (p *redactionPlan) transform(v reflect.Value, path string, key []byte, transformed map[string]string) {
+	for _, a := range p.fields {
+		f := v.Field(a.index)
+		fpath := a.name
+		if len(path) > 0 {
+			fpath = path + "." + a.name
+		}
+
+		if a.nested != nil {
+			a.nested.transformNested(f, fpath, key, transformed)
+			continue
+		}
+		if a.dynamic {
+			transformDynamic(f, fpath, key, transformed)
+			continue
+		}
+
+		if f.IsZero() {
+			continue
+		}
+
+		switch a.action {
+		case tagOmit:
+			f.Set(reflect.Zero(f.Type()))
+		case tagRedact:
+			if f.Kind() == reflect.String {
+				f.SetString(redacted)
+			} else {
+				f.Set(reflect.Zero(f.Type()))
+			}
+		case tagHash:
+			f.SetString(hmacHex(key, f.String()))
+		}
+		transformed[fpath] = a.action
+	}
+}
+
+func (p *redactionPlan) transformNested(f reflect.Value, path string, key []byte, transformed map[string]string) {
+	switch f.Kind() {
+	case reflect.Struct:
+		p.transform(f, path, key, transformed)
+
+	case reflect.Ptr:
+		if !f.IsNil() {
+			cp := reflect.New(f.Type().Elem())
+			cp.Elem().Set(f.Elem())
+			p.transform(cp.Elem(), path, key, transformed)
+			f.Set(cp)
+		}
+
+	case reflect.Slice:
+		if f.Len() > 0 {
+			cp := reflect.MakeSlice(f.Type(), f.Len(), f.Len())
+			reflect.Copy(cp, f)
+			f.Set(cp)
+		}
+		fallthrough
+
+	case reflect.Array:
+		for i := 0; i < f.Len(); i++ {
+			p.transformNested(f.Index(i), path+"[]", key, transformed)
+		}
+
+	case reflect.Map:
+		if f.Len() > 0 {
+			cp := reflect.MakeMapWithSize(f.Type(), f.Len())
+			for iter := f.MapRange(); iter.Next(); {
+				v := reflect.New(f.Type().Elem()).Elem()
+				v.Set(iter.Value())
+				p.transformNested(v, path+"[]", key, transformed)
+				cp.SetMapIndex(iter.Key(), v)
+			}
+			f.Set(cp)
+		}
+	}
+}
+
+// transformDynamic transforms the values of an interface field f, or
+// a pointer, slice, array or map of interfaces, by the plans of their
+// types.  Values of types with invalid dlog tags are omitted.
+func transformDynamic(f reflect.Value, path string, key []byte, transformed map[string]string) {
+	switch f.Kind() {
+	case reflect.Interface:
+		if f.IsNil() {
+			return
+		}
+		p, e := redactionPlanOfValue(f.Elem())
+		if e != nil {
+			f.Set(reflect.Zero(f.Type()))
+			transformed[path] = tagOmit
+			return
+		}
+		if p != nil {
+			v := reflect.New(f.Elem().Type()).Elem()
+			v.Set(f.Elem())
+			p.transformNested(v, path, key, transformed)
+			f.Set(v)
+		}
+
+	case reflect.Ptr:
+		if !f.IsNil() {
+			cp := reflect.New(f.Type().Elem())
+			cp.Elem().Set(f.Elem())
+			transformDynamic(cp.Elem(), path, key, transformed)
+			f.Set(cp)
+		}
+
+	default:
+		transformDynamicElems(f, path, key, transformed)
+	}
+}
+
+// transformDynamicElems transforms elements of the slice, array or
+// map f with transformDynamic.
+func transformDynamicElems(f reflect.Value, path string, key []byte, transformed map[string]string) {
+	switch f.Kind() {
+	case reflect.Slice:
+		if f.Len() > 0 {
+			cp := reflect.MakeSlice(f.Type(), f.Len(), f.Len())
+			reflect.Copy(cp, f)
+			f.Set(cp)
+		}
+		fallthrough
+
+	case reflect.Array:
+		for i := 0; i < f.Len(); i++ {
+			transformDynamic(f.Index(i), path+"[]", key, transformed)
+		}
+
+	case reflect.Map:
+		if f.Len() > 0 {
+			cp := reflect.MakeMapWithSize(f.Type(), f.Len())
+			for iter := f.MapRange(); iter.Next(); {
+				v := reflect.New(f.Type().Elem()).Elem()
+				v.Set(iter.Value())
+				transformDynamic(v, path+"[]", key, transformed)
+				cp.SetMapIndex(iter.Key(), v)
+			}
+			f.Set(cp)
+		}
+	}
+}
+
+func hmacHex(key []byte, s string) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return hex.EncodeToString(m.Sum(nil))
+}
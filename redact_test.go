@@ -0,0 +1,274 @@
+package dlog
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type searchUser struct {
+	ID    string `dlog:"hash"`
+	Email string `dlog:"redact"`
+	Age   int    `dlog:"redact"`
+}
+
+type privateImpression struct {
+	Session string `dlog:"hash"`
+	Query   string `dlog:"redact"`
+	Debug   string `dlog:"omit"`
+	Results []string
+	User    *searchUser
+	Friends []searchUser
+}
+
+func TestRedactionPlan(t *testing.T) {
+	assert := assert.New(t)
+
+	p, e := redactionPlanOf(reflect.TypeOf(privateImpression{}))
+	assert.Nil(e)
+	assert.Equal(5, len(p.fields))
+	assert.True(p.hashes())
+
+	// Plans are cached per type.
+	p2, _ := redactionPlanOf(reflect.TypeOf(privateImpression{}))
+	assert.True(p == p2)
+
+	p, e = redactionPlanOf(reflect.TypeOf(impression{}))
+	assert.Nil(e)
+	assert.Nil(p)
+
+	type BadHash struct {
+		Count int `dlog:"hash"`
+	}
+	_, e = redactionPlanOf(reflect.TypeOf(BadHash{}))
+	assert.NotNil(e)
+
+	type BadTag struct {
+		Name string `dlog:"encrypt"`
+	}
+	_, e = redactionPlanOf(reflect.TypeOf(BadTag{}))
+	assert.NotNil(e)
+
+	type Recursive struct {
+		Name string `dlog:"redact"`
+		Next *Recursive
+	}
+	p, e = redactionPlanOf(reflect.TypeOf(Recursive{}))
+	assert.Nil(e)
+	m, _ := p.apply(&Recursive{Name: "a", Next: &Recursive{Name: "b"}}, nil)
+	assert.Equal(redacted, m.(*Recursive).Next.Name)
+}
+
+func TestRedactionApply(t *testing.T) {
+	assert := assert.New(t)
+
+	p, e := redactionPlanOf(reflect.TypeOf(privateImpression{}))
+	assert.Nil(e)
+
+	key := []byte("secret")
+	msg := &privateImpression{
+		Session: "s1",
+		Query:   "my query",
+		Debug:   "debug info",
+		Results: []string{"r"},
+		User:    &searchUser{ID: "u1", Email: "a@b.c", Age: 30},
+		Friends: []searchUser{{ID: "u2"}},
+	}
+
+	m, transformed := p.apply(msg, key)
+	r := m.(*privateImpression)
+	assert.Equal(hmacHex(key, "s1"), r.Session)
+	assert.Equal(64, len(r.Session))
+	assert.Equal(redacted, r.Query)
+	assert.Equal("", r.Debug)
+	assert.Equal([]string{"r"}, r.Results)
+	assert.Equal(hmacHex(key, "u1"), r.User.ID)
+	assert.Equal(redacted, r.User.Email)
+	assert.Equal(0, r.User.Age)
+	assert.Equal(hmacHex(key, "u2"), r.Friends[0].ID)
+
+	assert.Equal(map[string]string{
+		"Session":      "hash",
+		"Query":        "redact",
+		"Debug":        "omit",
+		"User.ID":      "hash",
+		"User.Email":   "redact",
+		"User.Age":     "redact",
+		"Friends[].ID": "hash",
+	}, transformed)
+
+	// The message is not modified.
+	assert.Equal("s1", msg.Session)
+	assert.Equal("u1", msg.User.ID)
+	assert.Equal("u2", msg.Friends[0].ID)
+
+	// Values are copied like pointers.
+	v, _ := p.apply(privateImpression{Query: "q"}, key)
+	assert.Equal(redacted, v.(privateImpression).Query)
+}
+
+func TestLoggerRedactsFields(t *testing.T) {
+	assert := assert.New(t)
+
+	_, e := NewLogger(&privateImpression{}, &Options{
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.NotNil(e) // HashKey is required.
+
+	l, e := NewLogger(&privateImpression{}, &Options{
+		HashKey:        []byte("secret"),
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+	RegisterType(privateImpression{})
+
+	assert.Nil(l.LogSync(context.Background(), &privateImpression{Session: "s1", Query: "q"}))
+	assert.Nil(l.Close())
+
+	data := l.kinesis.(*kinesisMock).storage[l.streamName][0][0].Data
+	env, e := OpenEnvelope(data)
+	assert.Nil(e)
+	assert.Equal(map[string]string{"Session": "hash", "Query": "redact"}, env.Transformed)
+
+	m, e := Decode("github.com-topicai-dlog.privateimpression", data)
+	assert.Nil(e)
+	assert.Equal(redacted, m.(*privateImpression).Query)
+	assert.Equal(hmacHex([]byte("secret"), "s1"), m.(*privateImpression).Session)
+}
+
+type mutualA struct {
+	Name string `dlog:"redact"`
+	B    *mutualB
+}
+
+type mutualB struct {
+	Email string `dlog:"redact"`
+	A     *mutualA
+}
+
+type untaggedA struct {
+	B *untaggedB
+}
+
+type untaggedB struct {
+	A *untaggedA
+}
+
+type dynamicImpression struct {
+	Detail  interface{}
+	Details []interface{}
+	ByID    map[string]searchUser
+}
+
+func TestRedactionNestedKinds(t *testing.T) {
+	assert := assert.New(t)
+	key := []byte("secret")
+
+	// Mutually recursive types.
+	p, e := redactionPlanOf(reflect.TypeOf(mutualA{}))
+	assert.Nil(e)
+	m, _ := p.apply(&mutualA{Name: "a", B: &mutualB{Email: "b", A: &mutualA{Name: "c"}}}, key)
+	assert.Equal(redacted, m.(*mutualA).Name)
+	assert.Equal(redacted, m.(*mutualA).B.Email)
+	assert.Equal(redacted, m.(*mutualA).B.A.Name)
+
+	p, e = redactionPlanOf(reflect.TypeOf(untaggedA{}))
+	assert.Nil(e)
+	assert.Nil(p)
+
+	// Map values and values of interface fields.
+	p, e = redactionPlanOf(reflect.TypeOf(dynamicImpression{}))
+	assert.Nil(e)
+	assert.True(p.tagged()) // By ByID.
+	msg := &dynamicImpression{
+		Detail:  &searchUser{ID: "u1", Email: "a@b.c"},
+		Details: []interface{}{searchUser{Email: "d@e.f"}, "plain"},
+		ByID:    map[string]searchUser{"u2": {ID: "u2"}},
+	}
+	m, transformed := p.apply(msg, key)
+	r := m.(*dynamicImpression)
+	assert.Equal(hmacHex(key, "u1"), r.Detail.(*searchUser).ID)
+	assert.Equal(redacted, r.Detail.(*searchUser).Email)
+	assert.Equal(redacted, r.Details[0].(searchUser).Email)
+	assert.Equal("plain", r.Details[1])
+	assert.Equal(hmacHex(key, "u2"), r.ByID["u2"].ID)
+	assert.Equal(map[string]string{
+		"Detail.ID":       "hash",
+		"Detail.Email":    "redact",
+		"Details[].Email": "redact",
+		"ByID[].ID":       "hash",
+	}, transformed)
+
+	// The message is not modified.
+	assert.Equal("u1", msg.Detail.(*searchUser).ID)
+	assert.Equal("d@e.f", msg.Details[0].(searchUser).Email)
+	assert.Equal("u2", msg.ByID["u2"].ID)
+}
+
+type partlyTagged struct {
+	Query  string `dlog:"redact"`
+	Click  click
+	Clicks []click
+	ByID   map[string]*click
+	Loop   *untaggedA
+}
+
+type wrappedDetail struct {
+	Detail interface{}
+}
+
+func TestRedactionPlansSkipUntaggedFields(t *testing.T) {
+	assert := assert.New(t)
+
+	// Untagged nested fields are not in plans, so they are not copied.
+	p, e := redactionPlanOf(reflect.TypeOf(partlyTagged{}))
+	assert.Nil(e)
+	assert.Equal([]fieldAction{{index: 0, name: "Query", action: tagRedact}}, p.fields)
+
+	// Messages with tags only in values of interface fields are
+	// enveloped with the transformed fields.
+	l, e := NewLogger(&wrappedDetail{}, &Options{
+		HashKey:         []byte("secret"),
+		Implementations: []interface{}{searchUser{}},
+		UseMockKinesis:  true,
+		MockKinesis:     newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 1))
+	RegisterType(wrappedDetail{})
+
+	assert.Nil(l.LogSync(context.Background(), &wrappedDetail{Detail: searchUser{ID: "u1"}}))
+	assert.Nil(l.Close())
+
+	env, e := OpenEnvelope(l.kinesis.(*kinesisMock).storage[l.streamName][0][0].Data)
+	assert.Nil(e)
+	assert.Equal(map[string]string{"Detail.ID": "hash"}, env.Transformed)
+}
+
+type keyedSession struct {
+	Session string `dlog:"hash"`
+}
+
+func (k keyedSession) PartitionKey() string { return k.Session }
+
+func TestLoggerHashesPartitionKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	l, e := NewLogger(&keyedSession{}, &Options{
+		HashKey:        []byte("secret"),
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+	assert.Nil(l.LogSync(context.Background(), keyedSession{Session: "s1"}))
+	assert.Nil(l.Close())
+
+	r := l.kinesis.(*kinesisMock).storage[l.streamName][0][0]
+	assert.Equal(hmacHex([]byte("secret"), "s1"), r.PartitionKey)
+}
@@ -0,0 +1,170 @@
+package dlog
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/AdRoll/goamz/aws"
+)
+
+const defaultEndpointRegion = "us-east-1"
+
+var (
+	regionRegexp = regexp.MustCompile(`^[a-z]+(-[a-z]+)+-[0-9]+$`)
+
+	// partitions maps prefixes of region names to DNS suffixes of
+	// endpoints.  The longest prefix matches.
+	partitions = map[string]string{
+		"":         "amazonaws.com",
+		"cn-":      "amazonaws.com.cn",
+		"us-iso-":  "c2s.ic.gov",
+		"us-isob-": "sc2s.sgov.gov",
+	}
+	partitionsLock sync.RWMutex
+
+	// regions are the names of known regions of partitions above.
+	// Names of other regions of these partitions are likely typos.
+	regions = map[string]bool{
+		"af-south-1":     true,
+		"ap-east-1":      true,
+		"ap-east-2":      true,
+		"ap-northeast-1": true,
+		"ap-northeast-2": true,
+		"ap-northeast-3": true,
+		"ap-south-1":     true,
+		"ap-south-2":     true,
+		"ap-southeast-1": true,
+		"ap-southeast-2": true,
+		"ap-southeast-3": true,
+		"ap-southeast-4": true,
+		"ap-southeast-5": true,
+		"ap-southeast-6": true,
+		"ap-southeast-7": true,
+		"ca-central-1":   true,
+		"ca-west-1":      true,
+		"eu-central-1":   true,
+		"eu-central-2":   true,
+		"eu-north-1":     true,
+		"eu-south-1":     true,
+		"eu-south-2":     true,
+		"eu-west-1":      true,
+		"eu-west-2":      true,
+		"eu-west-3":      true,
+		"il-central-1":   true,
+		"me-central-1":   true,
+		"me-south-1":     true,
+		"mx-central-1":   true,
+		"sa-east-1":      true,
+		"us-east-1":      true,
+		"us-east-2":      true,
+		"us-west-1":      true,
+		"us-west-2":      true,
+		"us-gov-east-1":  true,
+		"us-gov-west-1":  true,
+		"cn-north-1":     true,
+		"cn-northwest-1": true,
+		"us-iso-east-1":  true,
+		"us-iso-west-1":  true,
+		"us-isob-east-1": true,
+	}
+
+	// registeredPartitions are prefixes of RegisterPartition, whose
+	// regions are all accepted.
+	registeredPartitions = make(map[string]bool)
+)
+
+// RegisterPartition registers the DNS suffix of endpoints of regions
+// whose names start with prefix, like "cn-" and "amazonaws.com.cn",
+// so that dlog resolves endpoints of new AWS partitions.  Any region
+// name of the partition is accepted.
+func RegisterPartition(prefix, dnsSuffix string) {
+	partitionsLock.Lock()
+	defer partitionsLock.Unlock()
+	partitions[prefix] = dnsSuffix
+	registeredPartitions[prefix] = true
+}
+
+// RegisterRegion registers the name of a region newer than dlog, like
+// "ap-southeast-8", so that dlog resolves its endpoints.  Names of
+// unknown regions fail with ErrUnknownRegion, as they are more likely
+// typos than new regions.
+func RegisterRegion(name string) {
+	partitionsLock.Lock()
+	defer partitionsLock.Unlock()
+	regions[strings.ToLower(name)] = true
+}
+
+// knownRegion returns whether name is a known or registered region,
+// or of a registered partition.
+func knownRegion(name string) bool {
+	partitionsLock.RLock()
+	defer partitionsLock.RUnlock()
+
+	if regions[name] {
+		return true
+	}
+	for prefix := range registeredPartitions {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRegion returns the region of name with the Kinesis endpoint.
+// If endpoint is not empty, like http://localhost:4567 of kinesalite,
+// it replaces the endpoint of the region, and name defaults to
+// us-east-1 for signing requests.
+func resolveRegion(name, endpoint string) (aws.Region, error) {
+	name = strings.ToLower(name)
+
+	if len(endpoint) > 0 {
+		if len(name) <= 0 {
+			name = defaultEndpointRegion
+		}
+		region := aws.Regions[name]
+		region.Name = name
+		region.KinesisEndpoint = endpoint
+		return region, nil
+	}
+
+	if region, ok := aws.Regions[name]; ok && len(region.KinesisEndpoint) > 0 {
+		return region, nil
+	}
+
+	if !regionRegexp.MatchString(name) || !knownRegion(name) {
+		return aws.Region{}, fmt.Errorf("%w %q: use RegisterRegion for new regions, or set Options.Endpoint for non-standard endpoints",
+			ErrUnknownRegion, name)
+	}
+
+	region := aws.Regions[name]
+	region.Name = name
+	region.KinesisEndpoint = serviceEndpoint("kinesis", name)
+	if len(region.STSEndpoint) <= 0 {
+		region.STSEndpoint = serviceEndpoint("sts", name)
+	}
+	return region, nil
+}
+
+// serviceEndpoint returns the public HTTPS endpoint of service in
+// region.
+func serviceEndpoint(service, region string) string {
+	partitionsLock.RLock()
+	defer partitionsLock.RUnlock()
+
+	prefixes := make([]string, 0, len(partitions))
+	for prefix := range partitions {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(region, prefix) {
+			return fmt.Sprintf("https://%s.%s.%s", service, region, partitions[prefix])
+		}
+	}
+	return "" // Unreachable, as the empty prefix matches.
+}
@@ -0,0 +1,105 @@
+package dlog
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Sampling keeps a deterministic fraction of messages.  A message is
+// kept if the first 8 bytes of the MD5 of its key, as a big-endian
+// unsigned integer, is less than Rate × 2^64.  The key is the value
+// of KeyField, like "Session" or "User.ID", formatted by fmt.Sprint,
+// so every service sampling at the same rate keeps the same sessions.
+// If KeyField is empty, the key is the gob-encoded message.
+type Sampling struct {
+	Rate     float64
+	KeyField string
+}
+
+// SampledMessage is implemented by message types that declare their
+// sampling.  Options.Sampling overrides it.
+type SampledMessage interface {
+	Sampling() Sampling
+}
+
+// sampler is a Sampling checked against a message type.
+type sampler struct {
+	rate  float64
+	field []string // Path of KeyField.
+}
+
+// newSampler returns the sampler of messages of type t given opts and
+// an example message, or nil if they don't sample.
+func newSampler(t reflect.Type, example interface{}, opts *Options) (*sampler, error) {
+	var s Sampling
+	if opts.Sampling != nil {
+		s = *opts.Sampling
+	} else if m, ok := example.(SampledMessage); ok {
+		s = m.Sampling()
+	} else {
+		return nil, nil
+	}
+
+	if s.Rate <= 0 || s.Rate > 1 || math.IsNaN(s.Rate) {
+		return nil, fmt.Errorf("Sampling rate of %v must be in (0, 1], got %v", t, s.Rate)
+	}
+
+	var field []string
+	if len(s.KeyField) > 0 {
+		field = strings.Split(s.KeyField, ".")
+		ft := t
+		for _, name := range field {
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() != reflect.Struct {
+				return nil, fmt.Errorf("Sampling key field %s of %v not found", s.KeyField, t)
+			}
+			f, ok := ft.FieldByName(name)
+			if !ok || len(f.PkgPath) > 0 {
+				return nil, fmt.Errorf("Sampling key field %s of %v not found", s.KeyField, t)
+			}
+			ft = f.Type
+		}
+	}
+
+	return &sampler{rate: s.Rate, field: field}, nil
+}
+
+// keep returns if msg, which is encoded as en, is kept.
+func (s *sampler) keep(msg interface{}, en []byte) bool {
+	if s.rate >= 1 {
+		return true
+	}
+
+	key := en
+	if len(s.field) > 0 {
+		key = []byte(fmt.Sprint(s.key(msg)))
+	}
+	return keepHash(key, s.rate)
+}
+
+// key returns the value of the key field of msg, or nil if a pointer
+// on the path is nil.
+func (s *sampler) key(msg interface{}) interface{} {
+	v := reflect.ValueOf(msg)
+	for _, name := range s.field {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return nil
+			}
+			v = v.Elem()
+		}
+		v = v.FieldByName(name)
+	}
+	return v.Interface()
+}
+
+func keepHash(key []byte, rate float64) bool {
+	h := md5.Sum(key)
+	return float64(binary.BigEndian.Uint64(h[:8])) < rate*math.Exp2(64)
+}
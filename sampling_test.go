@@ -0,0 +1,100 @@
+package dlog
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sampledImpression struct {
+	Session string
+	Query   string
+}
+
+func (sampledImpression) Sampling() Sampling {
+	return Sampling{Rate: 0.1, KeyField: "Session"}
+}
+
+func TestSamplerIsDeterministicPerKey(t *testing.T) {
+	assert := assert.New(t)
+
+	s, e := newSampler(reflect.TypeOf(sampledImpression{}), sampledImpression{}, &Options{})
+	assert.Nil(e)
+	assert.Equal(0.1, s.rate)
+
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		session := strconv.Itoa(i)
+		k := s.keep(sampledImpression{Session: session, Query: "a"}, nil)
+		// Messages of the same session are kept together, even by
+		// other message types.
+		assert.Equal(k, s.keep(&sampledImpression{Session: session, Query: "b"}, nil))
+		assert.Equal(k, keepHash([]byte(session), 0.1))
+		if k {
+			kept++
+		}
+	}
+	assert.InDelta(1000, kept, 100)
+
+	// Options override message types.
+	s, e = newSampler(reflect.TypeOf(sampledImpression{}), sampledImpression{},
+		&Options{Sampling: &Sampling{Rate: 1}})
+	assert.Nil(e)
+	assert.True(s.keep(sampledImpression{}, nil))
+
+	s, e = newSampler(reflect.TypeOf(click{}), click{}, &Options{})
+	assert.Nil(e)
+	assert.Nil(s)
+}
+
+func TestSamplerErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	type Nested struct {
+		User struct{ ID int }
+	}
+	typ := reflect.TypeOf(Nested{})
+
+	_, e := newSampler(typ, Nested{}, &Options{Sampling: &Sampling{Rate: 0}})
+	assert.NotNil(e)
+	_, e = newSampler(typ, Nested{}, &Options{Sampling: &Sampling{Rate: 1.5}})
+	assert.NotNil(e)
+	_, e = newSampler(typ, Nested{}, &Options{Sampling: &Sampling{Rate: 0.5, KeyField: "User.Name"}})
+	assert.NotNil(e)
+
+	s, e := newSampler(typ, Nested{}, &Options{Sampling: &Sampling{Rate: 0.5, KeyField: "User.ID"}})
+	assert.Nil(e)
+	assert.Equal(7, s.key(Nested{User: struct{ ID int }{ID: 7}}))
+}
+
+func TestLoggerWritesSampleRate(t *testing.T) {
+	assert := assert.New(t)
+
+	l, e := NewLogger(&sampledImpression{}, &Options{
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(l.LogContext(context.Background(), sampledImpression{Session: strconv.Itoa(i)}))
+	}
+	assert.Nil(l.Close())
+
+	written, _ := strconv.Atoi(l.writtenRecords.String())
+	sampledOut, _ := strconv.Atoi(l.sampledOut.String())
+	assert.Equal(100, written+sampledOut)
+	assert.True(written > 0 && written < 50)
+
+	for _, batch := range l.kinesis.(*kinesisMock).storage[l.streamName] {
+		for _, entry := range batch {
+			env, e := OpenEnvelope(entry.Data)
+			assert.Nil(e)
+			assert.Equal(0.1, env.SampleRate)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package dlog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxMissingRanges bounds the memory of a producerSequence.  The
+// oldest ranges are forgotten, and stay counted as missing.
+const maxMissingRanges = 10000
+
+// newProducerID returns the host name followed by random bytes, which
+// is unique for each Logger, even if it restarts on the same host.
+func newProducerID() string {
+	host, e := os.Hostname()
+	if e != nil {
+		host = "unknown"
+	}
+
+	b := make([]byte, 8)
+	if _, e := rand.Read(b); e != nil {
+		return fmt.Sprintf("%s-%x", host, time.Now().UnixNano())
+	}
+	return host + "-" + hex.EncodeToString(b)
+}
+
+// ProducerLoss is the loss report of a producer, which is a Logger
+// identified by ProducerID.  Sequence numbers are counted from 1, so
+// Missing includes records lost before the first received one.
+type ProducerLoss struct {
+	ProducerID string
+	Received   int64  // Records received, including duplicates.
+	LastSeq    uint64 // Highest sequence number received.
+	Missing    int64  // Sequence numbers not received up to LastSeq.
+	Duplicates int64  // Records received more than once.
+	Reordered  int64  // Records received after higher sequence numbers.
+	LastHeard  time.Time
+}
+
+func (p ProducerLoss) String() string {
+	return fmt.Sprintf("producer %s: received %d, last seq %d, missing %d, duplicates %d, reordered %d",
+		p.ProducerID, p.Received, p.LastSeq, p.Missing, p.Duplicates, p.Reordered)
+}
+
+// seqRange is an inclusive range of missing sequence numbers.
+type seqRange struct {
+	from, to uint64
+}
+
+// producerSequence tracks the sequence numbers received from a
+// producer.
+type producerSequence struct {
+	loss    ProducerLoss
+	missing []seqRange // Sorted and disjoint.
+}
+
+// observe updates the counts with seq, and returns which of
+// "missing", "duplicate" or "reordered" changed and by how much.
+func (p *producerSequence) observe(seq uint64, now time.Time) (kind string, n int64) {
+	p.loss.Received++
+	p.loss.LastHeard = now
+
+	switch {
+	case seq > p.loss.LastSeq:
+		n = int64(seq - p.loss.LastSeq - 1)
+		if n > 0 {
+			p.missing = append(p.missing, seqRange{p.loss.LastSeq + 1, seq - 1})
+			if len(p.missing) > maxMissingRanges {
+				p.missing = p.missing[1:]
+			}
+		}
+		p.loss.LastSeq = seq
+		p.loss.Missing += n
+		return "missing", n
+
+	case p.fill(seq):
+		p.loss.Missing--
+		p.loss.Reordered++
+		return "reordered", 1
+
+	default:
+		p.loss.Duplicates++
+		return "duplicate", 1
+	}
+}
+
+// fill removes seq from the missing ranges, and returns false if it
+// is not missing.
+func (p *producerSequence) fill(seq uint64) bool {
+	i := sort.Search(len(p.missing), func(i int) bool { return p.missing[i].to >= seq })
+	if i >= len(p.missing) || p.missing[i].from > seq {
+		return false
+	}
+
+	r := p.missing[i]
+	switch {
+	case r.from == seq && r.to == seq:
+		p.missing = append(p.missing[:i], p.missing[i+1:]...)
+	case r.from == seq:
+		p.missing[i].from++
+	case r.to == seq:
+		p.missing[i].to--
+	default:
+		p.missing = append(p.missing, seqRange{})
+		copy(p.missing[i+1:], p.missing[i:])
+		p.missing[i] = seqRange{r.from, seq - 1}
+		p.missing[i+1] = seqRange{seq + 1, r.to}
+	}
+	return true
+}
+
+// sequenceTracker tracks producerSequence of every producer.
+type sequenceTracker struct {
+	lock      sync.Mutex
+	producers map[string]*producerSequence
+}
+
+func newSequenceTracker() *sequenceTracker {
+	return &sequenceTracker{producers: make(map[string]*producerSequence)}
+}
+
+func (t *sequenceTracker) observe(producerID string, seq uint64, now time.Time) (kind string, n int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	p, ok := t.producers[producerID]
+	if !ok {
+		p = &producerSequence{loss: ProducerLoss{ProducerID: producerID}}
+		t.producers[producerID] = p
+	}
+	return p.observe(seq, now)
+}
+
+// report returns the loss of every producer, sorted by producer ID.
+func (t *sequenceTracker) report() []ProducerLoss {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	report := make([]ProducerLoss, 0, len(t.producers))
+	for _, p := range t.producers {
+		report = append(report, p.loss)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].ProducerID < report[j].ProducerID })
+	return report
+}
@@ -0,0 +1,74 @@
+package dlog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProducerSequence(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &producerSequence{}
+	now := time.Now()
+	for _, seq := range []uint64{1, 2, 3, 7, 5, 5, 2, 10} {
+		p.observe(seq, now)
+	}
+	assert.Equal(int64(8), p.loss.Received)
+	assert.Equal(uint64(10), p.loss.LastSeq)
+	assert.Equal(int64(4), p.loss.Missing) // 4, 6, 8, 9
+	assert.Equal(int64(2), p.loss.Duplicates)
+	assert.Equal(int64(1), p.loss.Reordered)
+	assert.Equal([]seqRange{{4, 4}, {6, 6}, {8, 9}}, p.missing)
+
+	for _, seq := range []uint64{4, 9, 8, 6} {
+		kind, n := p.observe(seq, now)
+		assert.Equal("reordered", kind)
+		assert.Equal(int64(1), n)
+	}
+	assert.Equal(int64(0), p.loss.Missing)
+	assert.Empty(p.missing)
+}
+
+func TestReaderLossReport(t *testing.T) {
+	assert := assert.New(t)
+
+	l, e := NewLogger(&click{}, &Options{
+		Envelope:       true,
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+	for i := 0; i < 4; i++ {
+		assert.Nil(l.LogSync(context.Background(), click{Session: "s"}))
+	}
+	assert.Nil(l.Close())
+
+	var records [][]byte
+	for _, b := range l.kinesis.(*kinesisMock).storage[l.streamName] {
+		for _, entry := range b {
+			records = append(records, entry.Data)
+		}
+	}
+	assert.Equal(4, len(records))
+
+	r := NewReader(&ReaderOptions{LossReportPeriod: time.Millisecond})
+	defer r.Close()
+	for _, i := range []int{0, 2, 1, 1} { // The 2nd is reordered and duplicated.
+		_, e := r.Open(records[i])
+		assert.Nil(e)
+	}
+
+	report := r.LossReport()
+	assert.Equal(1, len(report))
+	assert.Equal(l.ProducerID(), report[0].ProducerID)
+	assert.Equal(uint64(3), report[0].LastSeq)
+	assert.Equal(int64(0), report[0].Missing)
+	assert.Equal(int64(1), report[0].Reordered)
+	assert.Equal(int64(1), report[0].Duplicates)
+	assert.Equal("1", r.reorderedRecords.Get(l.ProducerID()).String())
+	assert.Equal("0", r.missingRecords.Get(l.ProducerID()).String())
+}
@@ -0,0 +1,264 @@
+package dlog
+
+import (
+	"crypto/md5"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/goamz/kinesis"
+)
+
+const (
+	// Write limits of a Kinesis shard.
+	shardBytesPerSecond   = 1024 * 1024
+	shardRecordsPerSecond = 1000
+
+	defaultShardRefreshPeriod = time.Minute
+)
+
+// shardRange is the hash key range of an open shard.
+type shardRange struct {
+	id    string
+	start *big.Int
+	end   *big.Int
+}
+
+// shardLimiter maps partition keys to shards as Kinesis does, by the
+// MD5 of the key, and applies a token bucket for bytes and another for
+// records to each shard.
+type shardLimiter struct {
+	bytesPerSecond   float64
+	recordsPerSecond float64
+
+	lock    sync.Mutex
+	ranges  []shardRange // Sorted by start.
+	buckets map[string]*shardBuckets
+	now     func() time.Time
+}
+
+// shardBuckets are token buckets that allow bursts of one second.
+// Tokens can go negative, which is the debt that later batches wait
+// for.
+type shardBuckets struct {
+	bytes   float64
+	records float64
+	updated time.Time
+}
+
+func newShardLimiter(bytesPerSecond, recordsPerSecond int) *shardLimiter {
+	if bytesPerSecond <= 0 {
+		bytesPerSecond = shardBytesPerSecond
+	}
+	if recordsPerSecond <= 0 {
+		recordsPerSecond = shardRecordsPerSecond
+	}
+
+	return &shardLimiter{
+		bytesPerSecond:   float64(bytesPerSecond),
+		recordsPerSecond: float64(recordsPerSecond),
+		buckets:          make(map[string]*shardBuckets),
+		now:              time.Now,
+	}
+}
+
+// update replaces the shard map with open shards in desc.  Buckets of
+// shards still open are kept.
+func (s *shardLimiter) update(desc *kinesis.StreamDescription) error {
+	ranges := make([]shardRange, 0, len(desc.Shards))
+	for _, shard := range desc.Shards {
+		if len(shard.SequenceNumberRange.EndingSequenceNumber) > 0 {
+			continue // Closed shards don't accept records.
+		}
+
+		start, ok1 := new(big.Int).SetString(shard.HashKeyRange.StartingHashKey, 10)
+		end, ok2 := new(big.Int).SetString(shard.HashKeyRange.EndingHashKey, 10)
+		if !ok1 || !ok2 {
+			return fmt.Errorf("Invalid hash key range of shard %s: %+v", shard.ShardId, shard.HashKeyRange)
+		}
+		ranges = append(ranges, shardRange{id: shard.ShardId, start: start, end: end})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.Cmp(ranges[j].start) < 0 })
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buckets := make(map[string]*shardBuckets, len(ranges))
+	for _, r := range ranges {
+		if b, ok := s.buckets[r.id]; ok {
+			buckets[r.id] = b
+		}
+	}
+	s.ranges, s.buckets = ranges, buckets
+	return nil
+}
+
+// shard returns the ID of the shard of partition key, or "" if the
+// shard map is unknown.
+func (s *shardLimiter) shard(key string) string {
+	hash := partitionKeyHash(key)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	i := sort.Search(len(s.ranges), func(i int) bool { return s.ranges[i].start.Cmp(hash) > 0 }) - 1
+	if i >= 0 && hash.Cmp(s.ranges[i].end) <= 0 {
+		return s.ranges[i].id
+	}
+	return ""
+}
+
+// reserve takes tokens for records from the buckets of their shards,
+// and returns how long to wait before sending them, so that no shard
+// exceeds its limits.
+func (s *shardLimiter) reserve(records []*record) time.Duration {
+	type demand struct{ bytes, records float64 }
+	demands := make(map[string]*demand)
+	for _, r := range records {
+		id := s.shard(r.key)
+		if len(id) <= 0 {
+			continue
+		}
+
+		d, ok := demands[id]
+		if !ok {
+			d = &demand{}
+			demands[id] = d
+		}
+		d.bytes += float64(len(r.data) + len(r.key))
+		d.records++
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	wait := time.Duration(0)
+	for id, d := range demands {
+		b, ok := s.buckets[id]
+		if !ok {
+			b = &shardBuckets{bytes: s.bytesPerSecond, records: s.recordsPerSecond, updated: now}
+			s.buckets[id] = b
+		}
+
+		// Refill, up to a burst of one second.
+		elapsed := now.Sub(b.updated).Seconds()
+		b.bytes = minFloat(b.bytes+elapsed*s.bytesPerSecond, s.bytesPerSecond)
+		b.records = minFloat(b.records+elapsed*s.recordsPerSecond, s.recordsPerSecond)
+		b.updated = now
+
+		b.bytes -= d.bytes
+		b.records -= d.records
+		if w := debt(b.bytes, s.bytesPerSecond); w > wait {
+			wait = w
+		}
+		if w := debt(b.records, s.recordsPerSecond); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// KinesisShardPager is implemented by Kinesis clients that read the
+// DescribeStream page of shards after exclusiveStartShardId.  Logger
+// needs it for shard maps of streams with more shards than a page.
+type KinesisShardPager interface {
+	DescribeStreamPage(name, exclusiveStartShardId string) (*kinesis.StreamDescription, error)
+}
+
+// describeShards returns the description of stream name with shards
+// of all DescribeStream pages.
+func describeShards(k KinesisInterface, name string) (*kinesis.StreamDescription, error) {
+	page, e := k.DescribeStream(name)
+	if e != nil {
+		return nil, e
+	}
+	desc := *page
+	desc.Shards = append([]kinesis.Shard(nil), page.Shards...)
+
+	for page.HasMoreShards {
+		pager, ok := k.(KinesisShardPager)
+		if !ok {
+			return nil, fmt.Errorf("Stream %s has more shards than a DescribeStream page, but %T doesn't implement KinesisShardPager",
+				name, k)
+		}
+		if len(page.Shards) <= 0 {
+			return nil, fmt.Errorf("DescribeStream of %s has more shards, but its page is empty", name)
+		}
+
+		page, e = pager.DescribeStreamPage(name, page.Shards[len(page.Shards)-1].ShardId)
+		if e != nil {
+			return nil, e
+		}
+		desc.Shards = append(desc.Shards, page.Shards...)
+	}
+	desc.HasMoreShards = false
+	return &desc, nil
+}
+
+// refresh updates the shard map from DescribeStream every period
+// until done is closed.
+func (s *shardLimiter) refresh(k KinesisInterface, streamName string, period time.Duration, done <-chan struct{}) {
+	if period <= 0 {
+		period = defaultShardRefreshPeriod
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		if desc, e := describeShards(k, streamName); e != nil {
+			log.Printf("DescribeStream failed: %v", e)
+		} else if e := s.update(desc); e != nil {
+			log.Printf("dlog cannot update shard map: %v", e)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// partitionKeyHash returns the MD5 of key as a 128-bit integer, which
+// Kinesis maps into hash key ranges of shards.
+func partitionKeyHash(key string) *big.Int {
+	h := md5.Sum([]byte(key))
+	return new(big.Int).SetBytes(h[:])
+}
+
+// evenShard returns the index of the shard of hash among count shards
+// of even hash key ranges, like those of a new stream, where range i
+// starts at 2^128*i/count rounded down.
+func evenShard(hash *big.Int, count int32) int32 {
+	n := big.NewInt(int64(count))
+	i := new(big.Int).Mul(hash, n)
+	i.Rsh(i, 128)
+
+	// Rounding down starts of ranges moves hashes at the boundaries
+	// into the next range.
+	next := new(big.Int).Add(i, big.NewInt(1))
+	next.Lsh(next, 128).Div(next, n)
+	if next.Cmp(hash) <= 0 {
+		i.Add(i, big.NewInt(1))
+	}
+	return int32(i.Int64())
+}
+
+// debt returns the time to refill a negative number of tokens.
+func debt(tokens, perSecond float64) time.Duration {
+	if tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tokens / perSecond * float64(time.Second))
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
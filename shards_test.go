@@ -0,0 +1,206 @@
+package dlog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/goamz/kinesis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardLimiterMapsKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newShardLimiter(0, 0)
+	assert.Equal("", s.shard("a")) // Unknown shard map.
+
+	shards := evenShards(2)
+	// A closed shard covering all keys is ignored.
+	shards = append(shards, kinesis.Shard{
+		ShardId: "closed",
+		HashKeyRange: kinesis.HashKeyRange{
+			StartingHashKey: "0",
+			EndingHashKey:   "340282366920938463463374607431768211455",
+		},
+		SequenceNumberRange: kinesis.SequenceNumberRange{EndingSequenceNumber: "1"},
+	})
+	assert.Nil(s.update(&kinesis.StreamDescription{Shards: shards}))
+
+	// MD5("a") = 0cc175b9..., MD5("b") = 92eb5ffe...
+	assert.Equal("shardId-000000000000", s.shard("a"))
+	assert.Equal("shardId-000000000001", s.shard("b"))
+
+	assert.NotNil(s.update(&kinesis.StreamDescription{Shards: []kinesis.Shard{{ShardId: "bad"}}}))
+}
+
+func TestShardLimiterReserve(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	s := newShardLimiter(1000, 10)
+	s.now = func() time.Time { return now }
+	assert.Nil(s.update(&kinesis.StreamDescription{Shards: evenShards(2)}))
+
+	records := func(key string, n, size int) []*record {
+		rs := make([]*record, n)
+		for i := range rs {
+			rs[i] = &record{data: make([]byte, size-len(key)), key: key}
+		}
+		return rs
+	}
+
+	// Within the burst of one second.
+	assert.Equal(time.Duration(0), s.reserve(records("a", 10, 10)))
+
+	// The shard of "a" is out of record tokens, but not the shard of "b".
+	assert.Equal(500*time.Millisecond, s.reserve(records("a", 5, 10)))
+	assert.Equal(time.Duration(0), s.reserve(records("b", 5, 10)))
+
+	// Tokens refill over time, and bytes are limited too.
+	now = now.Add(2 * time.Second)
+	assert.Equal(time.Second, s.reserve(records("a", 2, 1000)))
+}
+
+func TestLoggerShardRateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	l, e := NewLogger(&keyedClick{}, &Options{
+		BatchRecords:          5,
+		ShardRateLimit:        true,
+		ShardRecordsPerSecond: 10,
+		UseMockKinesis:        true,
+		MockKinesis:           newKinesisMock(0),
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 1))
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(l.shards.update(&kinesis.StreamDescription{Shards: evenShards(1)}))
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		assert.Nil(l.Log(keyedClick{Session: "s"}))
+	}
+	assert.Nil(l.Close())
+
+	// 20 records to a shard of 10 records per second.
+	assert.True(time.Since(start) >= 900*time.Millisecond)
+	assert.Equal("20", l.writtenRecords.String())
+}
+
+func TestEvenShard(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newShardLimiter(0, 0)
+	for _, n := range []int{1, 3, 4, 7} {
+		assert.Nil(s.update(&kinesis.StreamDescription{Shards: evenShards(n)}))
+		for i := 0; i < 1000; i++ {
+			key := strconv.Itoa(i)
+			assert.Equal(fmt.Sprintf("shardId-%012d", evenShard(partitionKeyHash(key), int32(n))), s.shard(key))
+		}
+	}
+
+	// Hashes at the start of a range, which is rounded down.
+	start, _ := new(big.Int).SetString(evenShards(3)[1].HashKeyRange.StartingHashKey, 10)
+	assert.Equal(int32(1), evenShard(start, 3))
+	assert.Equal(int32(0), evenShard(new(big.Int).Sub(start, big.NewInt(1)), 3))
+}
+
+// pagingKinesis returns shards of kinesisMock in DescribeStream pages
+// of pageSize shards.
+type pagingKinesis struct {
+	*kinesisMock
+	pageSize int
+	pages    int
+}
+
+func (k *pagingKinesis) DescribeStream(name string) (*kinesis.StreamDescription, error) {
+	return k.DescribeStreamPage(name, "")
+}
+
+func (k *pagingKinesis) DescribeStreamPage(name, exclusiveStartShardId string) (*kinesis.StreamDescription, error) {
+	desc, e := k.kinesisMock.DescribeStream(name)
+	if e != nil {
+		return nil, e
+	}
+	k.pages++
+
+	start := 0
+	for i, shard := range desc.Shards {
+		if shard.ShardId == exclusiveStartShardId {
+			start = i + 1
+		}
+	}
+	end := start + k.pageSize
+	if end < len(desc.Shards) {
+		desc.HasMoreShards = true
+	} else {
+		end = len(desc.Shards)
+	}
+	desc.Shards = desc.Shards[start:end]
+	return desc, nil
+}
+
+func TestShardLimiterPages(t *testing.T) {
+	assert := assert.New(t)
+
+	k := &pagingKinesis{kinesisMock: newKinesisMock(0), pageSize: 2}
+	assert.Nil(k.CreateStream("s", 5))
+
+	desc, e := describeShards(k, "s")
+	assert.Nil(e)
+	assert.Equal(3, k.pages)
+	assert.Equal(evenShards(5), desc.Shards)
+	assert.False(desc.HasMoreShards)
+
+	// Keys of shards on the last page are rate limited too.
+	s := newShardLimiter(0, 0)
+	done := make(chan struct{})
+	close(done)
+	s.refresh(k, "s", time.Minute, done)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		assert.Equal(fmt.Sprintf("shardId-%012d", evenShard(partitionKeyHash(key), 5)), s.shard(key))
+	}
+
+	// Clients without pages fail, rather than miss shards.
+	_, e = describeShards(struct{ KinesisInterface }{k}, "s")
+	assert.NotNil(e)
+}
+
+func TestCredentialedKinesisDescribeStreamPage(t *testing.T) {
+	assert := assert.New(t)
+
+	var req map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("Kinesis_20131202.DescribeStream", r.Header.Get("X-Amz-Target"))
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["StreamName"] == "missing" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type": "ResourceNotFoundException", "message": "not found"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"StreamDescription": kinesis.StreamDescription{Shards: evenShards(2)[1:]},
+		})
+	}))
+	defer server.Close()
+
+	k, e := (&Options{AccessKey: exampleAccessKey, SecretKey: exampleSecretKey, Endpoint: server.URL}).kinesis()
+	assert.Nil(e)
+	desc, e := k.(KinesisShardPager).DescribeStreamPage("s", "shardId-000000000000")
+	assert.Nil(e)
+	assert.Equal("shardId-000000000000", req["ExclusiveStartShardId"])
+	assert.Equal(evenShards(2)[1:], desc.Shards)
+
+	_, e = k.(KinesisShardPager).DescribeStreamPage("missing", "")
+	var ke *kinesis.Error
+	assert.True(errors.As(e, &ke))
+	assert.Equal("ResourceNotFoundException", ke.Code)
+}
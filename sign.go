@@ -0,0 +1,81 @@
+package dlog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// signEnvelope signs env by HMAC-SHA256 with the current key of keys.
+// It must be called after all other fields of env are set.
+func signEnvelope(env *Envelope, keys KeyProvider) error {
+	id, key, e := keys.CurrentKey()
+	if e != nil {
+		return e
+	}
+
+	env.SigningKeyID = id
+	env.Signature = signature(env, key)
+	return nil
+}
+
+// verifyEnvelope returns an error matching ErrInvalidSignature unless
+// env is signed by a key of keys.
+func verifyEnvelope(env *Envelope, keys KeyProvider) error {
+	if len(env.Signature) <= 0 {
+		return fmt.Errorf("%w: record not signed", ErrInvalidSignature)
+	}
+
+	key, e := keys.Key(env.SigningKeyID)
+	if e != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, e)
+	}
+
+	if !hmac.Equal(env.Signature, signature(env, key)) {
+		return fmt.Errorf("%w: signed with key %s", ErrInvalidSignature, env.SigningKeyID)
+	}
+	return nil
+}
+
+// signature computes the HMAC of every field of env but Signature.
+// Gob doesn't encode maps in a stable order, so the fields are framed
+// by appendFrame instead.
+func signature(env *Envelope, key []byte) []byte {
+	buf := appendMetadata(nil, env)
+	buf = appendFrame(buf, []byte(env.ProducerID))
+	buf = appendFrame(buf, []byte(fmt.Sprint(env.Seq)))
+	buf = appendFrame(buf, []byte(env.RecordID))
+	buf = appendFrame(buf, env.Heartbeat.signed())
+	buf = appendFrame(buf, []byte(env.KeyID))
+	buf = appendFrame(buf, env.Nonce)
+	buf = appendFrame(buf, []byte(env.SigningKeyID))
+	buf = appendFrame(buf, env.Message)
+
+	m := hmac.New(sha256.New, key)
+	m.Write(buf)
+	return m.Sum(nil)
+}
+
+// appendMetadata appends to buf the frames of env.SampleRate and
+// env.Transformed, sorted by path.
+func appendMetadata(buf []byte, env *Envelope) []byte {
+	var rate [8]byte
+	binary.BigEndian.PutUint64(rate[:], math.Float64bits(env.SampleRate))
+
+	paths := make([]string, 0, len(env.Transformed))
+	for path := range env.Transformed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	buf = appendFrame(buf, rate[:])
+	buf = appendFrame(buf, []byte(fmt.Sprint(len(paths))))
+	for _, path := range paths {
+		buf = appendFrame(buf, []byte(path))
+		buf = appendFrame(buf, []byte(env.Transformed[path]))
+	}
+	return buf
+}
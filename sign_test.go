@@ -0,0 +1,89 @@
+package dlog
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "signing.json")
+	writeKeyring(t, path, "s1", "s1")
+	keys, e := NewKeyring(path)
+	assert.Nil(e)
+
+	env := &Envelope{SampleRate: 0.5, Transformed: map[string]string{"A": "hash", "B": "omit"}, Message: []byte("m")}
+	assert.Nil(signEnvelope(env, keys))
+	assert.Equal("s1", env.SigningKeyID)
+	assert.Nil(verifyEnvelope(env, keys))
+
+	// Map order doesn't matter.
+	cp := *env
+	cp.Transformed = map[string]string{"B": "omit", "A": "hash"}
+	assert.Nil(verifyEnvelope(&cp, keys))
+
+	for _, tamper := range []func(*Envelope){
+		func(env *Envelope) { env.Message = []byte("n") },
+		func(env *Envelope) { env.SampleRate = 1 },
+		func(env *Envelope) { env.Transformed = nil },
+		func(env *Envelope) { env.SigningKeyID = "s2" },
+		func(env *Envelope) { env.Signature = nil },
+	} {
+		cp := *env
+		tamper(&cp)
+		assert.True(errors.Is(verifyEnvelope(&cp, keys), ErrInvalidSignature))
+	}
+}
+
+func TestSignedLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, e := ioutil.TempDir("", "dlog")
+	assert.Nil(e)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "signing.json")
+	writeKeyring(t, path, "s1", "s1")
+	keys, e := NewKeyring(path)
+	assert.Nil(e)
+
+	l, e := NewLogger(&click{}, &Options{
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+		SigningKeys:    keys,
+	})
+	assert.Nil(e)
+	assert.Nil(l.MockKinesis.CreateStream(l.streamName, 2))
+	assert.Nil(l.LogSync(context.Background(), click{Session: "s"}))
+	assert.Nil(l.Close())
+	signed := l.kinesis.(*kinesisMock).storage[l.streamName][0][0].Data
+
+	tampered := make([]byte, len(signed))
+	copy(tampered, signed)
+	tampered[len(tampered)-2] ^= 1 // In Message, the last field.
+
+	// Count invalid signatures.
+	r := NewReader(&ReaderOptions{SigningKeys: keys})
+	_, e = r.Open(signed)
+	assert.Nil(e)
+	_, e = r.Open(tampered)
+	assert.Nil(e)
+	assert.Equal("1", r.invalidSignatures.String())
+
+	// Reject invalid signatures.
+	r = NewReader(&ReaderOptions{SigningKeys: keys, RejectInvalidSignatures: true})
+	_, e = r.Open(signed)
+	assert.Nil(e)
+	_, e = r.Open(tampered)
+	assert.True(errors.Is(e, ErrInvalidSignature))
+	assert.Equal("1", r.invalidSignatures.String())
+}
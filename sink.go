@@ -0,0 +1,83 @@
+package dlog
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/AdRoll/goamz/kinesis"
+)
+
+// SinkRecord is a record in a batch written to a Sink.  Data is the
+// sealed envelope.
+type SinkRecord struct {
+	Data         []byte
+	PartitionKey string
+}
+
+// Sink is the destination of batches of records flushed by Logger.
+// Put might be called concurrently, up to Options.MaxInFlight times
+// per Logger.
+type Sink interface {
+	// Put writes records into the stream.  It returns an error if
+	// the whole batch failed, or otherwise the error of each record,
+	// nil for records written, or nil if all records were written.
+	Put(streamName string, records []SinkRecord) (failed []error, e error)
+}
+
+// KinesisSink writes batches by Kinesis PutRecords.  It is the Sink
+// of Logger unless Options.Sink is set.
+type KinesisSink struct {
+	Kinesis KinesisInterface
+}
+
+func (s *KinesisSink) Put(streamName string, records []SinkRecord) ([]error, error) {
+	entries := make([]kinesis.PutRecordsRequestEntry, 0, len(records))
+	for _, r := range records {
+		entries = append(entries, kinesis.PutRecordsRequestEntry{
+			Data:         r.Data,
+			PartitionKey: r.PartitionKey,
+		})
+	}
+
+	resp, e := s.Kinesis.PutRecords(streamName, entries)
+	if e != nil {
+		return nil, fmt.Errorf("PutRecords failed: %w", e)
+	}
+	if resp.FailedRecordCount <= 0 {
+		return nil, nil
+	}
+	log.Printf("PutRecords some records failed: %+v", resp)
+
+	failed := make([]error, len(records))
+	for i := range records {
+		if i < len(resp.Records) && len(resp.Records[i].ErrorCode) > 0 {
+			failed[i] = fmt.Errorf("PutRecords failed: %s: %s", resp.Records[i].ErrorCode, resp.Records[i].ErrorMessage)
+		}
+	}
+	return failed, nil
+}
+
+// WriterSink writes records into W in frames, each of which is the
+// size of the record in 4 bytes big endian followed by the record.
+// It is mostly for development, like writing into os.Stdout
+// redirected to a file.
+type WriterSink struct {
+	lock sync.Mutex
+	W    io.Writer
+}
+
+func (s *WriterSink) Put(streamName string, records []SinkRecord) ([]error, error) {
+	var buf []byte
+	for _, r := range records {
+		buf = appendFrame(buf, r.Data)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, e := s.W.Write(buf); e != nil {
+		return nil, e
+	}
+	return nil, nil
+}
@@ -0,0 +1,174 @@
+package dlog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSink keeps records, and fails those whose messages have
+// Element "fail".
+type testSink struct {
+	lock    sync.Mutex
+	records map[string][]SinkRecord
+}
+
+func (s *testSink) Put(streamName string, records []SinkRecord) ([]error, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var failed []error
+	for i, r := range records {
+		if bytes.Contains(r.Data, []byte("fail")) {
+			if failed == nil {
+				failed = make([]error, len(records))
+			}
+			failed[i] = errors.New("failed")
+			continue
+		}
+		s.records[streamName] = append(s.records[streamName], r)
+	}
+	return failed, nil
+}
+
+func TestSink(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := &testSink{records: make(map[string][]SinkRecord)}
+	l, e := NewLogger(&click{}, &Options{
+		Sink:           sink,
+		UseMockKinesis: true,
+		MockKinesis:    newKinesisMock(0),
+	})
+	assert.Nil(e)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(l.LogSync(context.Background(), click{Element: strconv.Itoa(i)}))
+	}
+	assert.NotNil(l.LogSync(context.Background(), click{Element: "fail"}))
+	assert.Nil(l.Close())
+
+	assert.Equal(3, len(sink.records[l.streamName]))
+	assert.Equal("3", l.writtenRecords.String())
+	assert.Equal("1", l.failedRecords.String())
+	assert.Empty(l.kinesis.(*kinesisMock).storage[l.streamName])
+}
+
+// flakySink fails the whole call first, then every other record,
+// then nothing.
+type flakySink struct {
+	calls   int
+	records []SinkRecord
+}
+
+func (s *flakySink) Put(streamName string, records []SinkRecord) ([]error, error) {
+	s.calls++
+	switch s.calls {
+	case 1:
+		return nil, errors.New("unavailable")
+	case 2:
+		failed := make([]error, len(records))
+		for i := range records {
+			if i%2 == 1 {
+				failed[i] = errors.New("throttled")
+			} else {
+				s.records = append(s.records, records[i])
+			}
+		}
+		return failed, nil
+	}
+	s.records = append(s.records, records...)
+	return nil, nil
+}
+
+func TestLoggerRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, retries := range []int{0, 2} {
+		sink := &flakySink{}
+		l, e := NewLogger(&click{}, &Options{
+			BatchRecords:     4,
+			BatchAge:         time.Second,
+			Retries:          retries,
+			RetryBackoff:     time.Millisecond,
+			StreamNamePrefix: "dev",
+			Sink:             sink,
+		})
+		assert.Nil(e)
+
+		errs := make(chan error, 4)
+		for i := 0; i < 4; i++ {
+			go func(i int) {
+				errs <- l.LogSync(context.Background(), click{Element: strconv.Itoa(i)})
+			}(i)
+		}
+		failed := 0
+		for i := 0; i < 4; i++ {
+			if <-errs != nil {
+				failed++
+			}
+		}
+		assert.Nil(l.Close())
+
+		if retries == 0 {
+			assert.Equal(4, failed)
+			assert.Equal(int64(4), l.failedRecords.Value())
+			assert.Equal(int64(0), l.retriedRecords.Value())
+		} else {
+			// Retried as a whole, then the failed half again.
+			assert.Equal(0, failed)
+			assert.Equal(3, sink.calls)
+			assert.Equal(4, len(sink.records))
+			assert.Equal(int64(4), l.writtenRecords.Value())
+			assert.Equal(int64(6), l.retriedRecords.Value())
+		}
+	}
+}
+
+func TestSinkWithoutKinesis(t *testing.T) {
+	assert := assert.New(t)
+
+	// Neither Region nor credentials are needed by other sinks.
+	var buf bytes.Buffer
+	l, e := NewLogger(&click{}, &Options{
+		StreamNamePrefix: "dev",
+		SyncPeriod:       10 * time.Millisecond,
+		Sink:             &WriterSink{W: &buf},
+	})
+	assert.Nil(e)
+	assert.Nil(l.kinesis)
+	RegisterType(click{})
+	assert.Nil(l.LogSync(context.Background(), click{Session: "s"}))
+	assert.Nil(l.Close())
+
+	data, e := readFrame(&buf)
+	assert.Nil(e)
+	m, e := Decode("github.com-topicai-dlog.click", data)
+	assert.Nil(e)
+	assert.Equal("s", m.(*click).Session)
+}
+
+func TestWriterSink(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	s := &WriterSink{W: &buf}
+	failed, e := s.Put("stream", []SinkRecord{{Data: []byte("a")}, {Data: []byte("bc")}})
+	assert.Nil(failed)
+	assert.Nil(e)
+
+	for _, want := range []string{"a", "bc"} {
+		data, e := readFrame(&buf)
+		assert.Nil(e)
+		assert.Equal(want, string(data))
+	}
+	_, e = readFrame(&buf)
+	assert.Equal(io.EOF, e)
+}
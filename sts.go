@@ -0,0 +1,203 @@
+package dlog
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+)
+
+const (
+	stsVersion       = "2011-06-15"
+	stsDefaultRegion = "us-east-1"
+)
+
+// WebIdentityCredentials assumes RoleARN with the OIDC token in
+// TokenFile by STS AssumeRoleWithWebIdentity, like EKS service
+// accounts.  Empty fields default to AWS_ROLE_ARN,
+// AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_SESSION_NAME, and Endpoint
+// to STS of Region, which defaults to us-east-1.  The token file is
+// read every time, as it is rotated.
+type WebIdentityCredentials struct {
+	RoleARN     string
+	TokenFile   string
+	SessionName string
+	Duration    time.Duration
+	Region      string
+	Endpoint    string
+	Client      *http.Client
+}
+
+func (w *WebIdentityCredentials) Retrieve() (*Credentials, error) {
+	role := w.RoleARN
+	if len(role) <= 0 {
+		role = os.Getenv("AWS_ROLE_ARN")
+	}
+	tokenFile := w.TokenFile
+	if len(tokenFile) <= 0 {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if len(role) <= 0 || len(tokenFile) <= 0 {
+		return nil, fmt.Errorf("%w of web identity: no role or token file", ErrNoCredentials)
+	}
+
+	token, e := ioutil.ReadFile(tokenFile)
+	if e != nil {
+		return nil, fmt.Errorf("Cannot read web identity token: %v", e)
+	}
+
+	session := w.SessionName
+	if len(session) <= 0 {
+		session = os.Getenv("AWS_ROLE_SESSION_NAME")
+	}
+
+	form := stsForm("AssumeRoleWithWebIdentity", role, session, w.Duration)
+	form.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+
+	// AssumeRoleWithWebIdentity is not signed, as the token
+	// authenticates the caller.
+	req, e := stsRequest(w.Region, w.Endpoint, form)
+	if e != nil {
+		return nil, e
+	}
+	return stsCall(w.Client, "AssumeRoleWithWebIdentity", req)
+}
+
+// AssumeRoleCredentials assumes RoleARN with the credentials of Source
+// by STS AssumeRole.  Endpoint defaults to STS of Region, which
+// defaults to us-east-1.
+type AssumeRoleCredentials struct {
+	Source      CredentialsProvider
+	RoleARN     string
+	SessionName string
+	ExternalID  string
+	Duration    time.Duration
+	Region      string
+	Endpoint    string
+	Client      *http.Client
+}
+
+func (a *AssumeRoleCredentials) Retrieve() (*Credentials, error) {
+	if a.Source == nil || len(a.RoleARN) <= 0 {
+		return nil, fmt.Errorf("AssumeRoleCredentials requires Source and RoleARN")
+	}
+	source, e := a.Source.Retrieve()
+	if e != nil {
+		return nil, e
+	}
+
+	form := stsForm("AssumeRole", a.RoleARN, a.SessionName, a.Duration)
+	if len(a.ExternalID) > 0 {
+		form.Set("ExternalId", a.ExternalID)
+	}
+
+	req, e := stsRequest(a.Region, a.Endpoint, form)
+	if e != nil {
+		return nil, e
+	}
+	region := a.Region
+	if len(region) <= 0 {
+		region = stsDefaultRegion
+	}
+	aws.NewV4Signer(source.auth(), "sts", aws.Region{Name: region}).Sign(req)
+	return stsCall(a.Client, "AssumeRole", req)
+}
+
+func stsForm(action, role, session string, duration time.Duration) url.Values {
+	if len(session) <= 0 {
+		session = fmt.Sprintf("dlog-%d", time.Now().UnixNano())
+	}
+	form := url.Values{
+		"Action":          {action},
+		"Version":         {stsVersion},
+		"RoleArn":         {role},
+		"RoleSessionName": {session},
+	}
+	if duration > 0 {
+		form.Set("DurationSeconds", strconv.Itoa(int(duration/time.Second)))
+	}
+	return form
+}
+
+func stsRequest(region, endpoint string, form url.Values) (*http.Request, error) {
+	if len(region) <= 0 {
+		region = stsDefaultRegion
+	}
+	if len(endpoint) <= 0 {
+		endpoint = serviceEndpoint("sts", region)
+	}
+
+	req, e := http.NewRequest("POST", endpoint+"/", strings.NewReader(form.Encode()))
+	if e != nil {
+		return nil, e
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	req.Header.Set("X-Amz-Date", time.Now().UTC().Format("20060102T150405Z"))
+	return req, nil
+}
+
+// stsResponse is the XML response of AssumeRole and
+// AssumeRoleWithWebIdentity, whose results are in elements named
+// after the action.
+type stsResponse struct {
+	Result struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		}
+	} `xml:",any"`
+}
+
+type stsError struct {
+	Error struct {
+		Code    string
+		Message string
+	}
+}
+
+func stsCall(client *http.Client, action string, req *http.Request) (*Credentials, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, e := client.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+
+	content, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return nil, e
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var se stsError
+		xml.Unmarshal(content, &se)
+		return nil, fmt.Errorf("STS %s failed with status %d: %s: %s",
+			action, resp.StatusCode, se.Error.Code, se.Error.Message)
+	}
+
+	var r stsResponse
+	if e := xml.Unmarshal(content, &r); e != nil {
+		return nil, fmt.Errorf("Cannot decode STS response: %v", e)
+	}
+	c := r.Result.Credentials
+	if len(c.AccessKeyId) <= 0 || len(c.SecretAccessKey) <= 0 {
+		return nil, fmt.Errorf("STS response has no credentials")
+	}
+	return &Credentials{
+		AccessKey:    c.AccessKeyId,
+		SecretKey:    c.SecretAccessKey,
+		SessionToken: c.SessionToken,
+		Expiration:   c.Expiration,
+	}, nil
+}
@@ -1,6 +1,8 @@
 package dlog
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"log"
 	"reflect"
@@ -25,13 +27,20 @@ var (
 	msgTypes = make(map[string]reflect.Type)
 )
 
-func RegisterType(msg interface{}) {
+// RegisterType adds the type of msg into msgTypes.  If msg has
+// interface-typed fields, impls lists the concrete types that may
+// appear behind them; they are registered with gob under stable
+// names, so that both the producer and the consumer can encode and
+// decode them.  Interface fields are reported in the log.
+func RegisterType(msg interface{}, impls ...interface{}) {
 	t, e := msgType(msg)
 	candy.Must(e)
 
 	n, e := fullMsgTypeName(msg)
 	candy.Must(e)
 
+	candy.Must(registerImpls(t, impls))
+
 	if tt, exists := msgTypes[n]; exists {
 		if tt != t {
 			log.Panicf("Type name %s already correspond to %v", n, tt)
@@ -43,13 +52,16 @@ func RegisterType(msg interface{}) {
 
 func msgType(msg interface{}) (reflect.Type, error) {
 	t := reflect.TypeOf(msg)
+	if t == nil {
+		return nil, fmt.Errorf("%w: dlog message mustn't be nil", ErrWrongType)
+	}
 
 	if t.Kind() == reflect.Ptr {
 		t = t.Elem()
 	}
 
 	if t.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("dlog message must be either *struct or struct")
+		return nil, fmt.Errorf("%w: dlog message must be either *struct or struct", ErrWrongType)
 	}
 
 	return t, nil
@@ -62,11 +74,11 @@ func fullMsgTypeName(msg interface{}) (string, error) {
 	}
 
 	if len(t.Name()) <= 0 {
-		return "", fmt.Errorf("Cannot identity type name of dlog message")
+		return "", fmt.Errorf("%w: Cannot identity type name of dlog message", ErrInvalidStreamName)
 	}
 
 	if len(t.PkgPath()) <= 0 {
-		return "", fmt.Errorf("Cannot identity package of dlog message type %v", t.PkgPath())
+		return "", fmt.Errorf("%w: Cannot identity package of dlog message type %v", ErrInvalidStreamName, t)
 	}
 
 	// Kinesis stream names and S3 bucket names cannot have '/'.
@@ -80,8 +92,173 @@ func fullMsgTypeName(msg interface{}) (string, error) {
 	name = strings.ToLower(name)
 
 	if !streamNameRegexp.MatchString(name) {
-		return "", fmt.Errorf("dlog message full type name (%s) must match [a-zA-Z0-9_.-]+", name)
+		return "", fmt.Errorf("%w: dlog message full type name (%s) must match [a-zA-Z0-9_.-]+", ErrInvalidStreamName, name)
 	}
 
 	return name, nil
 }
+
+// Decode creates a message of the registered type named typeName, as
+// returned by fullMsgTypeName, and decodes the content of a Kinesis
+// record written by Logger into it.  It relies on the same gob
+// registrations as the producer, so the concrete types behind
+// interface fields must have been passed to RegisterType or
+// Options.Implementations.  To decode encrypted records, use
+// Reader.Decode.
+func Decode(typeName string, data []byte) (interface{}, error) {
+	return plainReader.Decode(typeName, data)
+}
+
+// decodeMessage is like Decode, but en is the gob-encoded message.
+func decodeMessage(typeName string, en []byte) (interface{}, error) {
+	t, ok := msgTypes[strings.ToLower(typeName)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown dlog message type %s", typeName)
+	}
+
+	v := reflect.New(t)
+	if e := gob.NewDecoder(bytes.NewReader(en)).DecodeValue(v); e != nil {
+		return nil, fmt.Errorf("Cannot decode dlog message of type %s: %v", typeName, e)
+	}
+	return v.Interface(), nil
+}
+
+// interfaceFields returns the paths of all interface-typed fields
+// reachable from t through struct fields, pointers, slices, arrays
+// and maps.
+func interfaceFields(t reflect.Type) []string {
+	var fields []string
+	walkTypes(t, "", make(map[reflect.Type]bool), func(path string, ft reflect.Type) {
+		if ft.Kind() == reflect.Interface {
+			fields = append(fields, path)
+		}
+	})
+	return fields
+}
+
+// walkTypes calls f with the path and type of t and of every type
+// reachable from t through exported struct fields, pointers, slices,
+// arrays and maps.  Unexported fields are skipped because gob
+// ignores them.
+func walkTypes(t reflect.Type, path string, visited map[reflect.Type]bool, f func(string, reflect.Type)) {
+	f(path, t)
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		walkTypes(t.Elem(), path+"[]", visited, f)
+
+	case reflect.Map:
+		walkTypes(t.Key(), path+"{key}", visited, f)
+		walkTypes(t.Elem(), path+"{}", visited, f)
+
+	case reflect.Struct:
+		if visited[t] {
+			return // Recursive types.
+		}
+		visited[t] = true
+
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if len(field.PkgPath) > 0 {
+				continue
+			}
+
+			p := field.Name
+			if len(path) > 0 {
+				p = path + "." + field.Name
+			}
+			walkTypes(field.Type, p, visited, f)
+		}
+	}
+}
+
+// registerImpls registers impls with gob under their stable names.
+// It logs the interface fields of message type t, and requires that
+// every implementation satisfies at least one of them.
+func registerImpls(t reflect.Type, impls []interface{}) error {
+	fields := interfaceFields(t)
+	if len(fields) > 0 && len(impls) == 0 {
+		log.Printf("dlog message type %v has interface fields %v, but no implementations are registered", t, fields)
+	}
+
+	for _, impl := range impls {
+		if impl == nil {
+			return fmt.Errorf("Implementation for interface fields of %v mustn't be nil", t)
+		}
+
+		if !implementsAny(t, reflect.TypeOf(impl)) {
+			return fmt.Errorf("%T doesn't implement any interface field %v of %v", impl, fields, t)
+		}
+
+		if e := registerGobName(impl); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func implementsAny(t, impl reflect.Type) bool {
+	found := false
+	walkTypes(t, "", make(map[reflect.Type]bool), func(_ string, ft reflect.Type) {
+		if ft.Kind() == reflect.Interface {
+			found = found || impl.Implements(ft)
+		}
+	})
+	return found
+}
+
+// checkEncodable returns an error if gob cannot encode messages of
+// type t.  Gob silently drops exported fields of chan and func types,
+// and fails on them inside slices or maps, so we reject them all.
+func checkEncodable(t reflect.Type) error {
+	var bad []string
+	walkTypes(t, "", make(map[reflect.Type]bool), func(path string, ft reflect.Type) {
+		switch ft.Kind() {
+		case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+			bad = append(bad, fmt.Sprintf("%s (%v)", path, ft))
+		}
+	})
+	if len(bad) > 0 {
+		return fmt.Errorf("dlog message type %v has fields that cannot be encoded: %s",
+			t, strings.Join(bad, ", "))
+	}
+
+	if _, e := encode(reflect.New(t).Interface()); e != nil {
+		return e
+	}
+	return nil
+}
+
+// gobName returns the name under which dlog registers impl with gob.
+// Unlike the default name used by gob.Register, it includes the full
+// package path, so it doesn't depend on how packages are imported.
+// As with gob.Register, a type can be registered either as a value or
+// as a pointer, but not both.
+func gobName(impl interface{}) string {
+	t := reflect.TypeOf(impl)
+
+	star := ""
+	if t.Kind() == reflect.Ptr {
+		star = "*"
+		t = t.Elem()
+	}
+
+	if len(t.Name()) <= 0 || len(t.PkgPath()) <= 0 {
+		return star + t.String()
+	}
+	return star + t.PkgPath() + "." + t.Name()
+}
+
+// registerGobName calls gob.RegisterName, which panics if impl was
+// registered before under another name, and returns the panic as an
+// error.
+func registerGobName(impl interface{}) (e error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e = fmt.Errorf("Cannot register %T with gob: %v", impl, r)
+		}
+	}()
+
+	gob.RegisterName(gobName(impl), impl)
+	return nil
+}
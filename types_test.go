@@ -1,6 +1,8 @@
 package dlog
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"strings"
 	"testing"
@@ -52,3 +54,68 @@ func TestRegisterType(t *testing.T) {
 
 	assert.Panics(func() { RegisterType(anotherType{}) }) // msgTypes keys are lower-case strings.
 }
+
+type shape interface {
+	Area() float64
+}
+
+type square struct {
+	Side float64
+}
+
+func (s square) Area() float64 { return s.Side * s.Side }
+
+type circle struct {
+	Radius float64
+}
+
+func (c *circle) Area() float64 { return 3.14 * c.Radius * c.Radius }
+
+type drawing struct {
+	Name   string
+	Main   shape
+	Others []shape
+	Tags   map[string]interface{}
+	Next   *drawing
+}
+
+func TestInterfaceFields(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]string{"Main", "Others[]", "Tags{}"},
+		interfaceFields(reflect.TypeOf(drawing{})))
+
+	type Flat struct {
+		Name string
+	}
+	assert.Empty(interfaceFields(reflect.TypeOf(Flat{})))
+}
+
+func TestRegisterTypeWithImpls(t *testing.T) {
+	assert := assert.New(t)
+
+	RegisterType(drawing{}, square{}, "a string for Tags")
+	assert.Equal("github.com/topicai/dlog.square", gobName(square{}))
+	assert.Equal("*github.com/topicai/dlog.circle", gobName(&circle{}))
+
+	// Registering twice is harmless.
+	assert.NotPanics(func() { RegisterType(drawing{}, square{}) })
+
+	var buf bytes.Buffer
+	d := drawing{Name: "d", Main: square{Side: 2}, Others: []shape{square{Side: 3}}}
+	assert.Nil(gob.NewEncoder(&buf).Encode(d))
+
+	v, e := Decode("github.com-topicai-dlog.drawing", buf.Bytes())
+	assert.Nil(e)
+	assert.Equal(&d, v)
+
+	_, e = Decode("github.com-topicai-dlog.unknown", buf.Bytes())
+	assert.NotNil(e)
+
+	// Tags accepts anything, but Frame accepts only shapes.
+	type Frame struct {
+		Content shape
+	}
+	type Unrelated struct{}
+	assert.Panics(func() { RegisterType(Frame{}, Unrelated{}) })
+}